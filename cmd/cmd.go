@@ -1,7 +1,52 @@
 package cmd
 
-import "log"
+import (
+	"log"
+	"time"
+
+	"honnef.co/go/idxgrep/config"
+	"honnef.co/go/idxgrep/es"
+)
 
 func init() {
 	log.SetFlags(0)
 }
+
+// NewClient returns a client for the given index, configured
+// according to the global section of cfg.
+func NewClient(cfg *config.Config, index string) (*es.Client, error) {
+	g := cfg.Global
+	var timeout time.Duration
+	if g.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(g.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hc, err := es.NewHTTPClient(es.TransportOptions{
+		CACert:     g.CACert,
+		ClientCert: g.ClientCert,
+		ClientKey:  g.ClientKey,
+		Insecure:   g.InsecureSkipVerify,
+		Timeout:    timeout,
+		Proxy:      g.Proxy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &es.Client{
+		Base:  g.Server,
+		Index: index,
+		Auth: es.Auth{
+			Username:    g.Username,
+			Password:    g.Password,
+			APIKey:      g.APIKey,
+			BearerToken: g.BearerToken,
+		},
+		HTTPClient:       hc,
+		BulkMaxBytes:     g.BulkMaxBytes,
+		BulkMaxDocuments: g.BulkMaxDocuments,
+		MaxInflight:      g.MaxInflight,
+	}, nil
+}
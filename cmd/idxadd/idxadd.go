@@ -6,9 +6,8 @@ import (
 	"path/filepath"
 	"time"
 
-	_ "honnef.co/go/idxgrep/cmd"
+	"honnef.co/go/idxgrep/cmd"
 	"honnef.co/go/idxgrep/config"
-	"honnef.co/go/idxgrep/es"
 	"honnef.co/go/idxgrep/index"
 	"honnef.co/go/idxgrep/index/chat"
 	"honnef.co/go/idxgrep/index/regexp"
@@ -31,8 +30,9 @@ func main() {
 	}
 
 	var idx index.Index
-	client := &es.Client{
-		Base: cfg.Global.Server,
+	client, err := cmd.NewClient(cfg, "")
+	if err != nil {
+		log.Fatalln("Error configuring Elasticsearch client:", err)
 	}
 
 	switch fIndex {
@@ -46,11 +46,13 @@ func main() {
 		client.Index = cfg.ChatIndex.Index
 		idx = &chat.Weechat{
 			Client: client,
+			Config: cfg.ChatIndex,
 		}
 	case "discord":
 		client.Index = cfg.ChatIndex.Index
 		idx = &chat.Discord{
 			Client: client,
+			Config: cfg.ChatIndex,
 		}
 	default:
 		log.Fatalln("Unknown index type", fIndex)
@@ -69,5 +71,5 @@ func main() {
 	if err != nil {
 		log.Fatalln("Error indexing files:", err)
 	}
-	log.Printf("Indexed %d and skipped %d files in %s", stats.Indexed, stats.Skipped, time.Since(t))
+	log.Printf("Indexed %d, skipped %d and failed to index %d files in %s", stats.Indexed, stats.Skipped, stats.Failed, time.Since(t))
 }
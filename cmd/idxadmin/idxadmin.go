@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"honnef.co/go/idxgrep/cmd"
+	"honnef.co/go/idxgrep/config"
+	"honnef.co/go/idxgrep/es"
+	"honnef.co/go/idxgrep/index"
+	"honnef.co/go/idxgrep/index/chat"
+	"honnef.co/go/idxgrep/index/regexp"
+)
+
+// versionedIndex is an index whose schema can be migrated.
+type versionedIndex interface {
+	CreateIndex() error
+	// CreateVersion creates a new index using the current schema.
+	CreateVersion(name string) error
+	// Copy copies all documents to the index of dst.
+	Copy(dst *es.Client) (index.Statistics, error)
+}
+
+// outdated returns how idx differs from the configuration apart from
+// its schema version, for indices that can tell.
+func outdated(idx versionedIndex) string {
+	o, ok := idx.(interface {
+		Outdated() (string, error)
+	})
+	if !ok {
+		return ""
+	}
+	reason, err := o.Outdated()
+	if err != nil {
+		log.Fatalln("Couldn't compare index with configuration:", err)
+	}
+	return reason
+}
+
+type options struct {
+	keep bool
+}
+
+func status(client *es.Client, idx versionedIndex, current int) {
+	version, exists, err := index.Schema(client)
+	if err != nil {
+		log.Fatalln("Couldn't determine schema version:", err)
+	}
+	if !exists {
+		fmt.Printf("Index %q doesn't exist\n", client.Index)
+		return
+	}
+	target, err := client.AliasTarget()
+	if err != nil {
+		log.Fatalln("Couldn't resolve alias:", err)
+	}
+	if target != "" {
+		fmt.Printf("Index %q is an alias for %q\n", client.Index, target)
+	} else {
+		fmt.Printf("Index %q is not an alias\n", client.Index)
+	}
+	fmt.Printf("Schema version %d, current version %d\n", version, current)
+	reason := outdated(idx)
+	if reason != "" {
+		fmt.Printf("Index doesn't match the configuration: %s\n", reason)
+	}
+	if version != current || reason != "" {
+		fmt.Println("Run 'idxadmin migrate' to upgrade the index")
+	}
+}
+
+func migrate(client *es.Client, idx versionedIndex, current int, opts options) {
+	version, exists, err := index.Schema(client)
+	if err != nil {
+		log.Fatalln("Couldn't determine schema version:", err)
+	}
+	if !exists {
+		log.Printf("Index %q doesn't exist, creating it", client.Index)
+		if err := idx.CreateIndex(); err != nil {
+			log.Fatalln("Couldn't create index:", err)
+		}
+		return
+	}
+	reason := outdated(idx)
+	if version == current && reason == "" {
+		log.Printf("Index %q already uses schema version %d", client.Index, current)
+		return
+	}
+	target, err := client.AliasTarget()
+	if err != nil {
+		log.Fatalln("Couldn't resolve alias:", err)
+	}
+
+	name := index.VersionedName(client.Index, current)
+	if name == target {
+		// An earlier migration to the same version was interrupted
+		// after swapping the alias.
+		name = fmt.Sprintf("%s_%d", name, time.Now().Unix())
+	}
+	if version == current {
+		log.Printf("Rebuilding %q in %q because %s", client.Index, name, reason)
+	} else {
+		log.Printf("Migrating %q from schema version %d to %d in %q", client.Index, version, current, name)
+	}
+	if err := idx.CreateVersion(name); err != nil {
+		log.Fatalf("Couldn't create index %q: %s", name, err)
+	}
+	// Writes made during the copy wouldn't make it into the new
+	// index, so reject them until the alias refers to it.
+	old := target
+	if old == "" {
+		old = client.Index
+	}
+	if err := client.BlockWrites(old, true); err != nil {
+		log.Printf("Couldn't block writes to %q: %s", old, err)
+		if err := client.DeleteIndex(name); err != nil {
+			log.Printf("Couldn't delete %q: %s", name, err)
+		}
+		os.Exit(1)
+	}
+	t := time.Now()
+	stats, err := idx.Copy(client.WithIndex(name))
+	if err != nil {
+		log.Printf("Couldn't copy documents, leaving %q untouched: %s", client.Index, err)
+		if err := client.BlockWrites(old, false); err != nil {
+			log.Printf("Couldn't unblock writes to %q: %s", old, err)
+		}
+		if err := client.DeleteIndex(name); err != nil {
+			log.Printf("Couldn't delete %q: %s", name, err)
+		}
+		os.Exit(1)
+	}
+	log.Printf("Copied %d, skipped %d and failed to copy %d documents in %s", stats.Indexed, stats.Skipped, stats.Failed, time.Since(t))
+
+	actions := []es.AliasAction{{Type: "add", Index: name, Alias: client.Index}}
+	if target != "" {
+		actions = append(actions, es.AliasAction{Type: "remove", Index: target, Alias: client.Index})
+	} else {
+		// The index predates aliases and has to make room for the
+		// alias of the same name.
+		actions = append(actions, es.AliasAction{Type: "remove_index", Index: client.Index})
+		if opts.keep {
+			log.Printf("Can't keep %q because it isn't versioned", client.Index)
+		}
+	}
+	if err := client.UpdateAliases(actions...); err != nil {
+		log.Printf("Couldn't update alias: %s", err)
+		if err := client.BlockWrites(old, false); err != nil {
+			log.Printf("Couldn't unblock writes to %q: %s", old, err)
+		}
+		os.Exit(1)
+	}
+	log.Printf("Index %q now refers to %q", client.Index, name)
+
+	if target != "" && opts.keep {
+		if err := client.BlockWrites(target, false); err != nil {
+			log.Printf("Couldn't unblock writes to old index %q: %s", target, err)
+		}
+	}
+	if target != "" && !opts.keep {
+		if err := client.DeleteIndex(target); err != nil {
+			log.Fatalf("Couldn't delete old index %q: %s", target, err)
+		}
+		log.Printf("Deleted old index %q", target)
+	}
+}
+
+func main() {
+	var (
+		opts     options
+		fIndex   string
+		fVerbose bool
+	)
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION]... status|migrate\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Writes to the index are rejected while it is being migrated, so stop idxadd,")
+		fmt.Fprintln(flag.CommandLine.Output(), "idxrm and other writers first. Only Elasticsearch indices can be migrated.")
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&fIndex, "i", "regexp", "Index type: regexp or chat")
+	flag.BoolVar(&fVerbose, "v", false, "Verbose output")
+	flag.BoolVar(&opts.keep, "keep", false, "Keep the old index after migrating")
+	flag.Parse()
+	regexp.Verbose = fVerbose
+
+	if flag.NArg() != 1 {
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadFile(config.DefaultPath)
+	if err != nil {
+		log.Fatalln("Error loading configuration:", err)
+	}
+
+	var (
+		client  *es.Client
+		idx     versionedIndex
+		current int
+	)
+	switch fIndex {
+	case "regexp":
+		if cfg.RegexpIndex.Backend != config.BackendElasticsearch {
+			log.Fatalf("The regexp index uses the %s backend, which has no schema to migrate", cfg.RegexpIndex.Backend)
+		}
+		client, err = cmd.NewClient(cfg, cfg.RegexpIndex.Index)
+		idx = &regexp.Index{Client: client, Config: cfg.RegexpIndex}
+		current = regexp.SchemaVersion
+	case "chat":
+		if cfg.ChatIndex.Backend != config.BackendElasticsearch {
+			log.Fatalf("The chat index uses the %s backend, which has no schema to migrate", cfg.ChatIndex.Backend)
+		}
+		client, err = cmd.NewClient(cfg, cfg.ChatIndex.Index)
+		idx = &chat.Index{Client: client, Config: cfg.ChatIndex}
+		current = chat.SchemaVersion
+	default:
+		log.Fatalln("Unknown index type", fIndex)
+	}
+	if err != nil {
+		log.Fatalln("Error configuring Elasticsearch client:", err)
+	}
+
+	switch flag.Arg(0) {
+	case "status":
+		status(client, idx, current)
+	case "migrate":
+		migrate(client, idx, current, opts)
+	default:
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+}
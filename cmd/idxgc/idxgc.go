@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"honnef.co/go/idxgrep/cmd"
+	"honnef.co/go/idxgrep/config"
+	"honnef.co/go/idxgrep/fs"
+	"honnef.co/go/idxgrep/index/regexp"
+)
+
+type options struct {
+	verbose bool
+	dryRun  bool
+}
+
+type stats struct {
+	checked int
+	pruned  int
+	failed  int
+}
+
+// missing reports whether path, a file in the index, no longer
+// exists. A file only counts as missing if its parent directory still
+// exists, so that an unmounted file system doesn't look like a lot
+// of deleted files.
+func missing(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if err == nil || !os.IsNotExist(err) {
+		return false, err
+	}
+	fi, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+// gc removes files below roots that no longer exist from idx.
+func gc(idx *regexp.Index, roots []string, opts options) stats {
+	var st stats
+	// Files on disk, possibly containing further files, that we
+	// already checked.
+	exists := map[string]bool{}
+	// Files to remove, deleted all at once at the end
+	var ids, names []string
+	for _, root := range roots {
+		// Refuse to treat everything below a missing root as
+		// deleted.
+		fi, err := os.Stat(root)
+		if err != nil {
+			log.Printf("Skipping %s: %s", root, err)
+			st.failed++
+			continue
+		}
+		if !fi.IsDir() {
+			log.Printf("Skipping %s: not a directory", root)
+			st.failed++
+			continue
+		}
+		err = idx.Files(root, func(hit regexp.SearchHit) error {
+			st.checked++
+			path := filepath.Join(hit.Path, hit.Name)
+			name := strings.Replace(path, "\x00", " -> ", -1)
+
+			real := strings.SplitN(path, "\x00", 2)[0]
+			ok, seen := exists[real]
+			if !seen {
+				gone, err := missing(real)
+				if err != nil {
+					log.Printf("Couldn't check %s: %s", name, err)
+					st.failed++
+					return nil
+				}
+				ok = !gone
+				exists[real] = ok
+			}
+			if ok && real != path {
+				_, err := fs.Lstat(path)
+				switch {
+				case err == nil:
+				case os.IsNotExist(err):
+					ok = false
+				default:
+					log.Printf("Couldn't check %s: %s", name, err)
+					st.failed++
+					return nil
+				}
+			}
+			if ok {
+				if opts.verbose {
+					log.Printf("Keeping %s", name)
+				}
+				return nil
+			}
+
+			if opts.dryRun {
+				fmt.Println(name)
+				st.pruned++
+				return nil
+			}
+			ids = append(ids, hit.ID)
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			log.Fatalln("Error listing files:", err)
+		}
+	}
+	if len(ids) == 0 {
+		return st
+	}
+	failed, err := idx.DeleteIDs(ids...)
+	if err != nil {
+		log.Printf("Couldn't remove %d files: %s", len(ids), err)
+		st.failed += len(ids)
+		return st
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	st.pruned += len(ids) - failed
+	st.failed += failed
+	return st
+}
+
+func main() {
+	var opts options
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION]... PATH...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.BoolVar(&opts.verbose, "v", false, "Verbose output")
+	flag.BoolVar(&opts.dryRun, "n", false, "Only print files that would be removed")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadFile(config.DefaultPath)
+	if err != nil {
+		log.Fatalln("Error loading configuration:", err)
+	}
+
+	client, err := cmd.NewClient(cfg, cfg.RegexpIndex.Index)
+	if err != nil {
+		log.Fatalln("Error configuring Elasticsearch client:", err)
+	}
+	idx := &regexp.Index{Client: client, Config: cfg.RegexpIndex}
+
+	var roots []string
+	for _, arg := range flag.Args() {
+		root, err := filepath.Abs(arg)
+		if err != nil {
+			log.Fatalln("Couldn't determine absolute path:", err)
+		}
+		roots = append(roots, root)
+	}
+	st := gc(idx, roots, opts)
+	if opts.dryRun {
+		log.Printf("Checked %d files, would remove %d, failed to check %d", st.checked, st.pruned, st.failed)
+	} else {
+		log.Printf("Checked %d files, removed %d, failed %d", st.checked, st.pruned, st.failed)
+	}
+}
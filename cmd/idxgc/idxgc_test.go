@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"honnef.co/go/idxgrep/config"
+	"honnef.co/go/idxgrep/index/regexp"
+)
+
+func newIndex(t *testing.T, root string) *regexp.Index {
+	t.Helper()
+	cfg := config.DefaultConfig.RegexpIndex
+	cfg.Backend = config.BackendLocal
+	cfg.Path = filepath.Join(t.TempDir(), "test.idx")
+	idx := &regexp.Index{Config: cfg}
+	if err := idx.CreateIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Index(root); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func writeFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("package foo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func count(t *testing.T, idx *regexp.Index, root string) int {
+	t.Helper()
+	n, err := idx.Count(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "a.go", "b.go", "sub/c.go")
+	idx := newIndex(t, dir)
+
+	if err := os.Remove(filepath.Join(dir, "a.go")); err != nil {
+		t.Fatal(err)
+	}
+	st := gc(idx, []string{dir}, options{})
+	if st.checked != 3 || st.pruned != 1 || st.failed != 0 {
+		t.Errorf("gc() = %+v, want 3 checked, 1 pruned", st)
+	}
+	if n := count(t, idx, dir); n != 2 {
+		t.Errorf("%d files left in the index, want 2", n)
+	}
+}
+
+func TestGCMissingRoot(t *testing.T) {
+	// Files below a root that went away, e.g. because it was
+	// unmounted, must not be removed.
+	dir := t.TempDir()
+	root := filepath.Join(dir, "mnt")
+	writeFiles(t, root, "a.go", "sub/b.go")
+	idx := newIndex(t, root)
+
+	if err := os.Rename(root, filepath.Join(dir, "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	if st := gc(idx, []string{root}, options{}); st.pruned != 0 {
+		t.Errorf("gc() = %+v, want nothing pruned", st)
+	}
+	// The root exists, but the directories containing the files
+	// don't.
+	if st := gc(idx, []string{dir}, options{}); st.pruned != 0 {
+		t.Errorf("gc() = %+v, want nothing pruned", st)
+	}
+	if n := count(t, idx, root); n != 2 {
+		t.Errorf("%d files left in the index, want 2", n)
+	}
+}
@@ -1,22 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	stdregexp "regexp"
 	"regexp/syntax"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	_ "honnef.co/go/idxgrep/cmd"
+	"honnef.co/go/idxgrep/cmd"
 	"honnef.co/go/idxgrep/config"
-	"honnef.co/go/idxgrep/es"
-	"honnef.co/go/idxgrep/fs"
 	"honnef.co/go/idxgrep/index/chat"
 	idxregexp "honnef.co/go/idxgrep/index/regexp"
 	"honnef.co/go/idxgrep/internal/parser"
@@ -34,133 +41,587 @@ func (w *syncWriter) Write(b []byte) (int, error) {
 	return w.w.Write(b)
 }
 
-func queryRegexp(cfg *config.Config, opts regexOptions) {
-	pat := "(?m)" + opts.message
+func readPatterns(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pats []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		pats = append(pats, sc.Text())
+	}
+	return pats, sc.Err()
+}
+
+// pattern returns the regexp that matching lines have to match, and
+// the query for finding candidate files in an index of the n-grams g.
+// If lower is set, the query is for the lower-cased text.
+func pattern(pats []string, g parser.Grams, lower bool, opts regexOptions) (string, *parser.Query, error) {
+	if len(pats) == 0 {
+		return "", nil, errors.New("no patterns")
+	}
+	alts := make([]string, len(pats))
+	for i, p := range pats {
+		if opts.fixed {
+			p = stdregexp.QuoteMeta(p)
+		}
+		alts[i] = "(?:" + p + ")"
+	}
+	pat := strings.Join(alts, "|")
+	if opts.word {
+		pat = `\b(?:` + pat + `)\b`
+	}
+	if opts.line {
+		pat = `^(?:` + pat + `)$`
+	}
+	pat = "(?m)" + pat
 	if opts.caseInsensitive {
 		pat = "(?i)" + pat
 	}
 	re, err := syntax.Parse(pat, syntax.Perl)
+	if err != nil {
+		return "", nil, err
+	}
+	var q *parser.Query
+	switch {
+	case opts.invert:
+		// Any file may contain lines that don't match.
+		q = &parser.Query{Op: parser.QAll}
+	case opts.fixed && lower:
+		q = g.LowerLiteralQuery(pats)
+	case opts.fixed && !opts.caseInsensitive:
+		q = g.LiteralQuery(pats)
+	case lower:
+		q = g.LowerRegexpQuery(re)
+	default:
+		q = g.RegexpQuery(re)
+	}
+	return pat, q, nil
+}
+
+// A condition is a regexp that a file as a whole must match, or
+// must not match if negate is set.
+type condition struct {
+	pat    string
+	negate bool
+}
+
+func matchConditions(res []*regexp.Regexp, conds []condition, b []byte, multiline bool) bool {
+	for i, re := range res {
+		var match bool
+		if multiline {
+			match = re.MatchText(b)
+		} else {
+			match = re.Match(b, true, true) >= 0
+		}
+		if match == conds[i].negate {
+			return false
+		}
+	}
+	return true
+}
+
+type searchJob struct {
+	i   int
+	hit idxregexp.SearchHit
+}
+
+type searchResult struct {
+	i   int
+	out []byte
+	// Whether out contains groups of context lines
+	grouped bool
+}
+
+type jsonStats struct {
+	Type         string  `json:"type"`
+	Candidates   int     `json:"candidates"`
+	MatchedFiles uint64  `json:"matched_files"`
+	MatchedLines uint64  `json:"matched_lines"`
+	Pruned       uint64  `json:"pruned"`
+	Elapsed      float64 `json:"elapsed"` // in seconds
+}
+
+type jsonMessage struct {
+	Type    string        `json:"type"`
+	Message *chat.Message `json:"message"`
+}
+
+func queryRegexp(cfg *config.Config, opts regexOptions) {
+	t := time.Now()
+	pats := []string{opts.message}
+	if opts.patternFile != "" || len(opts.exprs) > 0 {
+		pats = append([]string(nil), opts.exprs...)
+		if opts.patternFile != "" {
+			fpats, err := readPatterns(opts.patternFile)
+			if err != nil {
+				log.Fatalln("Couldn't read patterns:", err)
+			}
+			pats = append(pats, fpats...)
+		}
+		// Like grep, treat all arguments as paths.
+		if opts.message != "" {
+			opts.args = append([]string{opts.message}, opts.args...)
+		}
+	}
+	if opts.sort == "score" && cfg.RegexpIndex.Backend == config.BackendLocal {
+		// The local backend doesn't score files.
+		log.Fatalln("-q.sort=score requires the Elasticsearch backend")
+	}
+	client, err := cmd.NewClient(cfg, cfg.RegexpIndex.Index)
+	if err != nil {
+		log.Fatalln("Error configuring Elasticsearch client:", err)
+	}
+	idx := idxregexp.Index{Client: client, Config: cfg.RegexpIndex}
+	info, err := idx.Info()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Searching the lower-cased text avoids expanding patterns into
+	// all their case variants.
+	lower := opts.caseInsensitive && info.LowerCase
+
+	pat, q, err := pattern(pats, info.Grams, lower, opts)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't parse regexp:", err)
+		os.Exit(2)
+	}
+
+	condOpts := opts
+	condOpts.invert = false
+	var conds []condition
+	for _, p := range opts.and {
+		cpat, cq, err := pattern([]string{p}, info.Grams, lower, condOpts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't parse regexp:", err)
+			os.Exit(2)
+		}
+		q = q.And(cq)
+		conds = append(conds, condition{pat: cpat})
+	}
+	for _, p := range opts.not {
+		// Trigrams can't tell us which files don't contain a
+		// pattern, so these only affect verification.
+		cpat, _, err := pattern([]string{p}, info.Grams, lower, condOpts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't parse regexp:", err)
+			os.Exit(2)
+		}
+		conds = append(conds, condition{pat: cpat, negate: true})
 	}
-	q := parser.RegexpQuery(re)
 	if opts.verbose {
 		log.Printf("Executing query: %s", q)
 	}
 
-	client := &es.Client{
-		Base:  cfg.Global.Server,
-		Index: cfg.RegexpIndex.Index,
+	var paths []string
+	for _, path := range append(opts.paths, opts.args...) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			log.Fatalln("Couldn't determine absolute path:", err)
+		}
+		paths = append(paths, abs)
 	}
-	idx := idxregexp.Index{Client: client}
-
-	hits, err := idx.Search(q, opts.count)
+	sopts := idxregexp.SearchOptions{
+		Paths:     paths,
+		Name:      opts.name,
+		LowerCase: lower,
+	}
+	if opts.explain {
+		ex, err := idx.Explain(q, sopts)
+		if err != nil {
+			log.Fatalln("Couldn't explain query:", err)
+		}
+		explain(os.Stderr, pat, q, ex)
+	}
+	hits, err := idx.Search(q, sopts, opts.count)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if opts.context > 0 {
+		if opts.after == 0 {
+			opts.after = opts.context
+		}
+		if opts.before == 0 {
+			opts.before = opts.context
+		}
+	}
+	var color bool
+	switch opts.color {
+	case "always":
+		color = true
+	case "never":
+	case "auto":
+		color = isTerminal(os.Stdout) && !opts.json
+	default:
+		log.Fatalf("Invalid value %q for -q.color", opts.color)
+	}
+
+	var ordered bool
+	switch opts.sort {
+	case "path":
+		ordered = true
+		sort.Slice(hits, func(i, j int) bool {
+			return filepath.Join(hits[i].Path, hits[i].Name) < filepath.Join(hits[j].Path, hits[j].Name)
+		})
+	case "score":
+		// Elasticsearch returns hits ordered by score.
+		ordered = true
+	case "none":
+	default:
+		log.Fatalf("Invalid value %q for -q.sort", opts.sort)
+	}
+
 	n := runtime.NumCPU()
 	wg := sync.WaitGroup{}
 	wg.Add(n)
-	work := make(chan string, n*2)
+	work := make(chan searchJob, n*2)
+	results := make(chan searchResult, n*2)
 	stdout := &syncWriter{w: os.Stdout}
 	stderr := &syncWriter{w: os.Stderr}
-	var matchedFiles uint64
+	var matchedFiles, matchedLines, pruned uint64
+	// Files that no longer exist, removed from the index after the
+	// search
+	var staleMu sync.Mutex
+	var staleIDs, staleNames []string
+	var flushes, fallbacks uint64
+	// Set once any worker printed a group of context lines, for
+	// separating groups of different files in unordered output
+	var grouped uint32
 	for i := 0; i < n; i++ {
 		go func() {
 			defer wg.Done()
 			re, _ := regexp.Compile(pat)
+			condRes := make([]*regexp.Regexp, len(conds))
+			for i, cond := range conds {
+				condRes[i], _ = regexp.Compile(cond.pat)
+			}
 			grep := regexp.Grep{
 				Stdout: stdout,
 				Stderr: stderr,
 				Regexp: re,
 				L:      opts.listOnly,
 				N:      opts.showLines,
+				Column: opts.column,
 				H:      opts.omitNames,
+				A:      opts.after,
+				B:      opts.before,
+				O:      opts.onlyMatching,
+				V:      opts.invert,
+				Count:  opts.countOnly,
+				Color:  color,
+				JSON:   opts.json,
+
+				Multiline: opts.multiline,
 			}
 
-			for path := range work {
-				grep.Match = false
-				f, err := fs.Open(path)
+			search := func(hit idxregexp.SearchHit) {
+				path := filepath.Join(hit.Path, hit.Name)
+				f, err := hit.Open()
 				if err != nil {
-					if opts.verbose {
-						log.Printf("Deleting missing file %q", path)
+					name := strings.Replace(path, "\x00", " -> ", -1)
+					if !opts.prune || !isStale(path, err) {
+						fmt.Fprintf(stderr, "%s: %v\n", name, err)
+						return
+					}
+					staleMu.Lock()
+					staleIDs = append(staleIDs, hit.ID)
+					staleNames = append(staleNames, name)
+					staleMu.Unlock()
+					return
+				}
+				if len(conds) > 0 {
+					// Read the file once for checking the
+					// conditions and for printing matches.
+					b, err := ioutil.ReadAll(f)
+					f.Close()
+					if err != nil {
+						fmt.Fprintf(stderr, "%s: %v\n", path, err)
+						return
+					}
+					if !matchConditions(condRes, conds, b, opts.multiline) {
+						return
 					}
-					// OPT(dh): we can evaluate full directory trees
-					// to optimize the cleaning
-					idx.Delete(filepath.Dir(path))
-					continue
+					grep.Reader(bytes.NewReader(b), path)
+				} else {
+					grep.Reader(f, path)
+					f.Close()
 				}
-				grep.Reader(f, path)
-				f.Close()
+			}
+
+			for job := range work {
+				var out *bytes.Buffer
+				if ordered {
+					// Buffer the output of each file so that
+					// it can be printed in order. The
+					// separator between files is printed
+					// along with it.
+					out = &bytes.Buffer{}
+					grep.Stdout = out
+					grep.Grouped = false
+				} else {
+					grep.Grouped = atomic.LoadUint32(&grouped) != 0
+				}
+				grep.Match = false
+				search(job.hit)
 				if grep.Match {
 					atomic.AddUint64(&matchedFiles, 1)
+					atomic.AddUint64(&matchedLines, uint64(grep.Matches))
+				}
+				if ordered {
+					results <- searchResult{job.i, out.Bytes(), grep.Grouped}
+				} else if grep.Grouped {
+					atomic.StoreUint32(&grouped, 1)
 				}
 			}
+			st := re.Stats()
+			atomic.AddUint64(&flushes, uint64(st.Flushes))
+			atomic.AddUint64(&fallbacks, uint64(st.NFAFallbacks))
 		}()
 	}
+
+	done := make(chan struct{})
+	go func() {
+		// Print results as soon as all files before them have been
+		// searched.
+		pending := map[int]searchResult{}
+		next := 0
+		sep := regexp.Grep{Stdout: os.Stdout, Color: color}
+		for res := range results {
+			pending[res.i] = res
+			for {
+				res, ok := pending[next]
+				if !ok {
+					break
+				}
+				if res.grouped {
+					if sep.Grouped {
+						sep.PrintSeparator()
+					}
+					sep.Grouped = true
+				}
+				os.Stdout.Write(res.out)
+				delete(pending, next)
+				next++
+			}
+		}
+		close(done)
+	}()
+
 	if opts.verbose {
 		log.Printf("Searching through %d candidate files", len(hits))
 	}
-	for _, hit := range hits {
-		name := hit.Name
-		path := filepath.Join(hit.Path, name)
-		work <- path
+	for i, hit := range hits {
+		work <- searchJob{i, hit}
 	}
 	close(work)
 	wg.Wait()
+	close(results)
+	<-done
+	if len(staleIDs) > 0 {
+		failed, err := idx.DeleteIDs(staleIDs...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't prune %d missing files from the index: %v\n", len(staleIDs), err)
+		} else {
+			for _, name := range staleNames {
+				fmt.Fprintf(os.Stderr, "Pruned missing file %s from the index\n", name)
+			}
+			pruned = uint64(len(staleIDs) - failed)
+		}
+	}
 	if opts.verbose {
 		log.Printf("Found matches in %d files", matchedFiles)
+		if flushes > 0 {
+			log.Printf("Flushed the DFA cache %d times, fell back to the NFA %d times", flushes, fallbacks)
+		}
+	}
+	if opts.explain {
+		rate := 0.0
+		if len(hits) > 0 {
+			rate = float64(matchedFiles) / float64(len(hits)) * 100
+		}
+		fmt.Fprintf(os.Stderr, "Searched candidates: %d\n", len(hits))
+		fmt.Fprintf(os.Stderr, "Matching files:      %d (%.1f%% of searched candidates)\n", matchedFiles, rate)
+	}
+	if opts.json {
+		json.NewEncoder(os.Stdout).Encode(jsonStats{
+			Type:         "stats",
+			Candidates:   len(hits),
+			MatchedFiles: matchedFiles,
+			MatchedLines: matchedLines,
+			Pruned:       pruned,
+			Elapsed:      time.Since(t).Seconds(),
+		})
 	}
 }
 
-func queryChat(cfg *config.Config, opts chatOptions) {
-	client := &es.Client{
-		Base:  cfg.Global.Server,
-		Index: cfg.ChatIndex.Index,
+// isStale reports whether err, returned by opening path, means that
+// the file no longer exists and should be removed from the index. To
+// guard against unmounted file systems, this requires the directory
+// containing the file to still exist.
+func isStale(path string, err error) bool {
+	if !os.IsNotExist(err) {
+		return false
 	}
-	idx := &chat.Index{Client: client}
-	q := es.BoolQuery{}
-	if opts.channel != "" {
-		q.And = append(q.And, es.Match{Key: "channel_or_person", Value: opts.channel})
+	real := strings.SplitN(path, "\x00", 2)[0]
+	fi, err := os.Stat(filepath.Dir(real))
+	return err == nil && fi.IsDir()
+}
+
+// explain prints how the query for pat is executed.
+func explain(w io.Writer, pat string, q *parser.Query, ex *idxregexp.Explanation) {
+	if re, err := syntax.Parse(pat, syntax.Perl); err == nil {
+		fmt.Fprintf(w, "Regexp:     %s\n", re.Simplify())
 	}
-	if opts.from != "" {
-		q.And = append(q.And, es.Match{Key: "from", Value: opts.from})
+	fmt.Fprintf(w, "Query:      %s\n", q)
+	fmt.Fprintf(w, "Simplified: %s\n", ex.Query)
+	fmt.Fprintf(w, "Plan:       %s\n", ex.Plan)
+	if ex.Request != nil {
+		fmt.Fprintf(w, "Elasticsearch query:\n%s\n", ex.Request)
 	}
-	if opts.protocol != "" {
-		q.And = append(q.And, es.Match{Key: "protocol", Value: opts.protocol})
+
+	used := map[string]bool{}
+	var walk func(q *parser.Query)
+	walk = func(q *parser.Query) {
+		for _, t := range q.Trigram {
+			used[t] = true
+		}
+		for _, sq := range q.Sub {
+			walk(sq)
+		}
 	}
-	if opts.server != "" {
-		q.And = append(q.And, es.Match{Key: "server", Value: opts.server})
+	walk(ex.Plan)
+	tris := make([]string, 0, len(ex.DocFreq.Trigrams))
+	for t := range ex.DocFreq.Trigrams {
+		tris = append(tris, t)
 	}
-	if opts.message != "" {
-		q.And = append(q.And, es.Match{Key: "message", Value: opts.message})
-		q.Or = append(q.Or, es.Match{Key: "message.shingles", Value: opts.message})
+	sort.Slice(tris, func(i, j int) bool {
+		fi, fj := ex.DocFreq.Trigrams[tris[i]], ex.DocFreq.Trigrams[tris[j]]
+		if fi != fj {
+			return fi < fj
+		}
+		return tris[i] < tris[j]
+	})
+	fmt.Fprintf(w, "Document frequencies (%d files):\n", ex.DocFreq.Total)
+	for _, t := range tris {
+		note := ""
+		if !used[t] {
+			note = " (dropped)"
+		}
+		fmt.Fprintf(w, "  %-8s %d%s\n", strconv.Quote(t), ex.DocFreq.Trigrams[t], note)
 	}
+	fmt.Fprintf(w, "Estimated candidates: %d\n", ex.Estimate)
+	fmt.Fprintf(w, "Actual candidates:    %d\n", ex.Candidates)
+}
 
-	s := es.Search{Query: q}
-	msgs, err := idx.Search(s, opts.count)
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return false
 	}
-	for _, msg := range msgs {
-		fmt.Println(msg)
+	return fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+func queryChat(cfg *config.Config, opts chatOptions) {
+	if opts.explain {
+		log.Fatalln("-explain is only supported for regexp queries")
 	}
+	client, err := cmd.NewClient(cfg, cfg.ChatIndex.Index)
+	if err != nil {
+		log.Fatalln("Error configuring Elasticsearch client:", err)
+	}
+	idx := &chat.Index{Client: client, Config: cfg.ChatIndex}
+	f := chat.Filter{
+		Protocol:        opts.protocol,
+		Server:          opts.server,
+		ChannelOrPerson: opts.channel,
+		From:            opts.from,
+		Text:            opts.message,
+	}
+	msgs, err := idx.Search(f, opts.count)
+	if err != nil {
+		log.Fatalln("Couldn't search messages:", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	emit := func(typ string, msg *chat.Message) {
+		if opts.json {
+			enc.Encode(jsonMessage{Type: typ, Message: msg})
+		} else {
+			fmt.Println(msg)
+		}
+	}
+	for i := range msgs {
+		if opts.context == 0 {
+			emit("message", &msgs[i])
+			continue
+		}
+		ctx, err := idx.Context(msgs[i], opts.context, 0)
+		if err != nil {
+			log.Fatalln("Couldn't fetch context:", err)
+		}
+		if i > 0 && !opts.json {
+			fmt.Println("--")
+		}
+		for j := range ctx {
+			emit("context", &ctx[j])
+		}
+		emit("message", &msgs[i])
+		ctx, err = idx.Context(msgs[i], 0, opts.context)
+		if err != nil {
+			log.Fatalln("Couldn't fetch context:", err)
+		}
+		for j := range ctx {
+			emit("context", &ctx[j])
+		}
+	}
+}
+
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 type generalOptions struct {
 	verbose bool
+	explain bool
+	json    bool
 	message string
 	count   int
+	args    []string
 }
 
 type regexOptions struct {
 	*generalOptions
 
 	caseInsensitive bool
+	invert          bool
+	word            bool
+	line            bool
+	fixed           bool
+	patternFile     string
+	exprs           stringList
+	and             stringList
+	not             stringList
 	listOnly        bool
 	showLines       bool
+	column          bool
+	multiline       bool
 	omitNames       bool
+	paths           stringList
+	name            string
+	after           int
+	before          int
+	context         int
+	countOnly       bool
+	onlyMatching    bool
+	color           string
+	sort            string
+	prune           bool
 }
 
 type chatOptions struct {
@@ -171,6 +632,7 @@ type chatOptions struct {
 	protocol string
 	server   string
 	channel  string
+	context  int
 }
 
 type queryMode struct {
@@ -186,14 +648,35 @@ func (m *queryMode) Set(s string) error {
 	switch s {
 	case "regexp":
 		flag.BoolVar(&m.regex.caseInsensitive, "q.i", false, "Case insensitive matching")
+		flag.BoolVar(&m.regex.invert, "q.v", false, "Select non-matching lines")
+		flag.BoolVar(&m.regex.word, "q.w", false, "Only match whole words")
+		flag.BoolVar(&m.regex.line, "q.x", false, "Only match whole lines")
+		flag.BoolVar(&m.regex.fixed, "q.F", false, "Interpret patterns as fixed strings")
+		flag.StringVar(&m.regex.patternFile, "q.f", "", "Read patterns from `file`, one per line")
+		flag.Var(&m.regex.exprs, "q.e", "Match `pattern` (may be repeated)")
+		flag.Var(&m.regex.and, "q.and", "Only search files that also match `pattern` (may be repeated)")
+		flag.Var(&m.regex.not, "q.not", "Only search files that don't match `pattern` (may be repeated)")
 		flag.BoolVar(&m.regex.listOnly, "q.l", false, "List matching files only")
 		flag.BoolVar(&m.regex.showLines, "q.n", false, "Show line numbers")
+		flag.BoolVar(&m.regex.column, "q.column", false, "Show the byte column of the first match on each line")
+		flag.BoolVar(&m.regex.multiline, "q.U", false, "Let matches span lines, reading whole files into memory")
 		flag.BoolVar(&m.regex.omitNames, "q.h", false, "Omit file names")
+		flag.IntVar(&m.regex.after, "q.A", 0, "Print `num` lines of trailing context")
+		flag.IntVar(&m.regex.before, "q.B", 0, "Print `num` lines of leading context")
+		flag.IntVar(&m.regex.context, "q.C", 0, "Print `num` lines of context")
+		flag.BoolVar(&m.regex.countOnly, "q.c", false, "Print the number of matching lines per file")
+		flag.BoolVar(&m.regex.onlyMatching, "q.o", false, "Print only the matching parts of lines")
+		flag.StringVar(&m.regex.color, "q.color", "auto", "Highlight matches: auto, always or never")
+		flag.StringVar(&m.regex.sort, "q.sort", "path", "Order of results: path, score (Elasticsearch only), or none for unordered output as soon as possible")
+		flag.BoolVar(&m.regex.prune, "q.prune", true, "Remove files that no longer exist from the index")
+		flag.Var(&m.regex.paths, "q.path", "Only search files in or below `path` (may be repeated)")
+		flag.StringVar(&m.regex.name, "q.name", "", "Only search files whose names match `glob`")
 	case "chat":
 		flag.StringVar(&m.chat.from, "q.from", "", "")
 		flag.StringVar(&m.chat.protocol, "q.protocol", "", "")
 		flag.StringVar(&m.chat.server, "q.server", "", "")
 		flag.StringVar(&m.chat.channel, "q.channel", "", "")
+		flag.IntVar(&m.chat.context, "q.C", 0, "Print `num` messages of context around each message")
 	default:
 		return errors.New("unknown query mode")
 	}
@@ -203,7 +686,7 @@ func (m *queryMode) Set(s string) error {
 
 func main() {
 	usage := func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION]... PATTERN\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION]... PATTERN [PATH]...\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.CommandLine.Usage = usage
@@ -213,19 +696,22 @@ func main() {
 	qm.chat.generalOptions = &qm.general
 	flag.Var(&qm, "q", "")
 	flag.BoolVar(&qm.general.verbose, "v", false, "Verbose output")
+	flag.BoolVar(&qm.general.explain, "explain", false, "Explain how the index is queried")
+	flag.BoolVar(&qm.general.json, "json", false, "Print results as JSON, one object per line")
 	flag.IntVar(&qm.general.count, "n", 10, "Max number of results")
 	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
 	if err := flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
 		os.Exit(2)
 	}
 
-	if flag.NArg() > 1 {
+	if flag.NArg() > 1 && qm.mode != "regexp" {
 		flag.CommandLine.Usage()
 		os.Exit(2)
 	}
 
 	if flag.NArg() > 0 {
 		qm.general.message = flag.Arg(0)
+		qm.general.args = flag.Args()[1:]
 	}
 
 	cfg, err := config.LoadFile(config.DefaultPath)
@@ -1,37 +1,258 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
-	_ "honnef.co/go/idxgrep/cmd"
+	"honnef.co/go/idxgrep/cmd"
 	"honnef.co/go/idxgrep/config"
 	"honnef.co/go/idxgrep/es"
+	"honnef.co/go/idxgrep/index/chat"
 	"honnef.co/go/idxgrep/index/regexp"
-	"honnef.co/go/spew"
 )
 
-func main() {
-	cfg, err := config.LoadFile(config.DefaultPath)
+type options struct {
+	verbose   bool
+	dryRun    bool
+	yes       bool
+	threshold int
+
+	protocol string
+	server   string
+	channel  string
+}
+
+type report struct {
+	deleted   int
+	failed    int
+	conflicts int
+}
+
+func (r *report) add(resp *es.ByQueryResponse) {
+	r.deleted += resp.Deleted
+	r.failed += len(resp.Failures)
+	r.conflicts += resp.VersionConflicts
+	for _, f := range resp.Failures {
+		log.Printf("Couldn't delete %s: %s: %s", f.ID, f.Cause.Type, f.Cause.Reason)
+	}
+}
+
+func (r *report) print() {
+	log.Printf("Deleted %d documents, %d failed, %d version conflicts", r.deleted, r.failed, r.conflicts)
+}
+
+// confirm asks the user whether to delete n documents, unless there
+// are few enough documents to not bother.
+func confirm(opts options, n int) bool {
+	if opts.yes || n <= opts.threshold {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "Delete %d documents? [y/N] ", n)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.TrimSpace(strings.ToLower(line)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// globRoot returns the longest leading directory of pattern that
+// doesn't contain any meta characters.
+func globRoot(pattern string) string {
+	dir := pattern
+	for strings.ContainsAny(dir, `*?[\`) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+func removeFiles(cfg *config.Config, opts options, args []string) {
+	client, err := cmd.NewClient(cfg, cfg.RegexpIndex.Index)
 	if err != nil {
-		log.Fatalln("Error loading configuration:", err)
+		log.Fatalln("Error configuring Elasticsearch client:", err)
+	}
+	idx := &regexp.Index{Client: client, Config: cfg.RegexpIndex}
+
+	type target struct {
+		path string
+		glob bool
+		// IDs of files matching a glob
+		ids []string
 	}
+	var targets []target
+	total := 0
+	for _, arg := range args {
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			log.Fatalln("Couldn't determine absolute path:", err)
+		}
+		if isGlob(path) {
+			// Globs are matched against the index, not the file
+			// system, so that files that no longer exist can be
+			// removed.
+			t := target{path: path, glob: true}
+			err := idx.Files(globRoot(path), func(hit regexp.SearchHit) error {
+				name := filepath.Join(hit.Path, hit.Name)
+				if ok, err := filepath.Match(path, name); err != nil || !ok {
+					return err
+				}
+				if opts.dryRun || opts.verbose {
+					fmt.Println(strings.Replace(name, "\x00", " -> ", -1))
+				}
+				t.ids = append(t.ids, hit.ID)
+				return nil
+			})
+			if err != nil {
+				log.Fatalf("Couldn't match %s: %s", arg, err)
+			}
+			targets = append(targets, t)
+			total += len(t.ids)
+			continue
+		}
 
-	client := &es.Client{
-		Base:  cfg.Global.Server,
-		Index: cfg.RegexpIndex.Index,
+		n, err := idx.Count(path)
+		if err != nil {
+			log.Fatalf("Couldn't count documents for %s: %s", arg, err)
+		}
+		if opts.dryRun || opts.verbose {
+			err := idx.Files(path, func(hit regexp.SearchHit) error {
+				fmt.Println(strings.Replace(filepath.Join(hit.Path, hit.Name), "\x00", " -> ", -1))
+				return nil
+			})
+			if err != nil {
+				log.Fatalf("Couldn't list documents for %s: %s", arg, err)
+			}
+		}
+		targets = append(targets, target{path: path})
+		total += n
 	}
 
-	target, err := filepath.Abs(os.Args[1])
+	if opts.dryRun {
+		log.Printf("Would delete %d documents", total)
+		return
+	}
+	if total == 0 {
+		log.Println("No matching documents")
+		return
+	}
+	if !confirm(opts, total) {
+		log.Println("Aborted")
+		return
+	}
+
+	var r report
+	// IDs of files matching globs, deleted all at once
+	var ids []string
+	for _, t := range targets {
+		if !t.glob {
+			resp, err := idx.Delete(t.path)
+			if err != nil {
+				log.Printf("Couldn't delete %s: %s", t.path, err)
+				continue
+			}
+			r.add(resp)
+			continue
+		}
+		// A glob that matched nothing has nothing to delete.
+		ids = append(ids, t.ids...)
+	}
+	if len(ids) > 0 {
+		failed, err := idx.DeleteIDs(ids...)
+		if err != nil {
+			log.Printf("Couldn't delete %d documents: %s", len(ids), err)
+			failed = len(ids)
+		}
+		r.deleted += len(ids) - failed
+		r.failed += failed
+	}
+	r.print()
+}
+
+func removeMessages(cfg *config.Config, opts options) {
+	client, err := cmd.NewClient(cfg, cfg.ChatIndex.Index)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalln("Error configuring Elasticsearch client:", err)
 	}
+	idx := &chat.Index{Client: client, Config: cfg.ChatIndex}
 
-	idx := &regexp.Index{Client: client}
-	resp, err := idx.Delete(target)
+	f := chat.Filter{
+		Protocol:        opts.protocol,
+		Server:          opts.server,
+		ChannelOrPerson: opts.channel,
+	}
+	if f.Empty() {
+		log.Fatalln("Refusing to delete all messages, use -protocol, -server or -channel")
+	}
+
+	n, err := idx.Count(f)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalln("Couldn't count messages:", err)
+	}
+	if opts.dryRun {
+		log.Printf("Would delete %d messages", n)
+		return
+	}
+	if n == 0 {
+		log.Println("No matching messages")
+		return
+	}
+	if !confirm(opts, n) {
+		log.Println("Aborted")
+		return
+	}
+	res, err := idx.Delete(f)
+	if err != nil {
+		log.Fatalln("Couldn't delete messages:", err)
+	}
+	r := report{deleted: res.Deleted, failed: res.Failed, conflicts: res.Conflicts}
+	r.print()
+}
+
+func main() {
+	var (
+		opts   options
+		fIndex string
+	)
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTION]... PATH...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -i chat [OPTION]...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&fIndex, "i", "regexp", "Index type: regexp or chat")
+	flag.BoolVar(&opts.verbose, "v", false, "Verbose output")
+	flag.BoolVar(&opts.dryRun, "n", false, "Only show what would be deleted")
+	flag.BoolVar(&opts.yes, "y", false, "Don't ask for confirmation")
+	flag.IntVar(&opts.threshold, "threshold", 100, "Ask for confirmation when deleting more than `num` documents")
+	flag.StringVar(&opts.protocol, "protocol", "", "Delete chat messages of this protocol")
+	flag.StringVar(&opts.server, "server", "", "Delete chat messages on this server")
+	flag.StringVar(&opts.channel, "channel", "", "Delete chat messages in this channel or with this person")
+	flag.Parse()
+
+	cfg, err := config.LoadFile(config.DefaultPath)
+	if err != nil {
+		log.Fatalln("Error loading configuration:", err)
+	}
+
+	switch fIndex {
+	case "regexp":
+		if flag.NArg() == 0 {
+			flag.CommandLine.Usage()
+			os.Exit(2)
+		}
+		removeFiles(cfg, opts, flag.Args())
+	case "chat":
+		removeMessages(cfg, opts)
+	default:
+		log.Fatalln("Unknown index type", fIndex)
 	}
-	spew.Dump(resp)
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -16,13 +17,37 @@ type FormatError struct {
 
 var DefaultPath = filepath.Join(configdir.LocalConfig("idxgrep"), "idxgrep.conf")
 
+// DefaultDataDir is where local indices are stored by default.
+var DefaultDataDir = configdir.LocalCache("idxgrep")
+
+// Backends for the regexp and chat indices.
+const (
+	BackendElasticsearch = "elasticsearch"
+	// Only for the regexp index
+	BackendLocal = "local"
+	// Only for the chat index
+	BackendSQLite = "sqlite"
+)
+
 var DefaultConfig = Config{
 	Global: Global{
-		Server: "http://localhost:9200",
+		Server:           "http://localhost:9200",
+		BulkMaxBytes:     8388608,
+		BulkMaxDocuments: 5000,
+		MaxInflight:      4,
 	},
 	RegexpIndex: RegexpIndex{
-		Index:       "files",
-		MaxFilesize: 10485760,
+		Index:            "files",
+		MaxFilesize:      10485760,
+		Workers:          4,
+		Backend:          BackendElasticsearch,
+		MaxQueryTrigrams: 16,
+		MinGram:          3,
+		MaxGram:          3,
+	},
+	ChatIndex: ChatIndex{
+		Index:   "chat",
+		Backend: BackendElasticsearch,
 	},
 }
 
@@ -34,15 +59,69 @@ type Config struct {
 
 type Global struct {
 	Server string `toml:"server"`
+	// Limits for a single bulk request. Smaller requests are easier
+	// on small clusters, larger ones are faster on big clusters.
+	BulkMaxBytes     int `toml:"bulk_max_bytes"`
+	BulkMaxDocuments int `toml:"bulk_max_documents"`
+	// Maximum number of concurrent bulk requests. The effective limit
+	// shrinks when Elasticsearch rejects requests and recovers as
+	// requests succeed.
+	MaxInflight int `toml:"max_inflight"`
+
+	// Credentials. Use either username and password, an API key or
+	// a bearer token.
+	Username    string `toml:"username"`
+	Password    string `toml:"password"`
+	APIKey      string `toml:"api_key"`
+	BearerToken string `toml:"bearer_token"`
+
+	// Paths to a PEM encoded CA bundle and client certificate.
+	CACert     string `toml:"ca_cert"`
+	ClientCert string `toml:"client_cert"`
+	ClientKey  string `toml:"client_key"`
+	// Don't verify the server's certificate.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+	// Request timeout as a duration such as "30s". Empty means no
+	// timeout.
+	Timeout string `toml:"timeout"`
+	// HTTP proxy. By default, the HTTP_PROXY and HTTPS_PROXY
+	// environment variables are used.
+	Proxy string `toml:"proxy"`
 }
 
 type RegexpIndex struct {
 	Index       string `toml:"index"`
 	MaxFilesize int    `toml:"max_filesize"`
+	// Number of files read and indexed concurrently.
+	Workers int `toml:"workers"`
+	// Where to store the index: BackendElasticsearch or BackendLocal.
+	Backend string `toml:"backend"`
+	// Path of the index file of the local backend. Defaults to a
+	// file named after Index in DefaultDataDir.
+	Path string `toml:"path"`
+	// Store compressed file contents in the index, so that searches
+	// don't have to read files from disk.
+	StoreContent bool `toml:"store_content"`
+	// Maximum number of trigrams in each conjunction of a search
+	// query. The rarest trigrams are kept. Zero uses a default, a
+	// negative value disables the limit.
+	MaxQueryTrigrams int `toml:"max_query_trigrams"`
+	// Lengths of the n-grams stored in the index. Longer n-grams
+	// make queries more selective, shorter ones allow searching for
+	// shorter strings; both increase the size of the index. Changing
+	// them requires rebuilding the index with 'idxadmin migrate'.
+	// The local backend only supports trigrams.
+	MinGram int `toml:"min_gram"`
+	MaxGram int `toml:"max_gram"`
 }
 
 type ChatIndex struct {
 	Index string `toml:"index"`
+	// Where to store messages: BackendElasticsearch or BackendSQLite.
+	Backend string `toml:"backend"`
+	// Path of the database of the SQLite backend. Defaults to a file
+	// named after Index in DefaultDataDir.
+	Path string `toml:"path"`
 }
 
 func Load(r io.Reader) (*Config, error) {
@@ -55,6 +134,23 @@ func Load(r io.Reader) (*Config, error) {
 	if err != nil {
 		return nil, FormatError{err}
 	}
+	switch cfg.RegexpIndex.Backend {
+	case "", BackendElasticsearch, BackendLocal:
+	default:
+		return nil, FormatError{fmt.Errorf("unknown backend %q", cfg.RegexpIndex.Backend)}
+	}
+	ri := cfg.RegexpIndex
+	if ri.MinGram < 1 || ri.MaxGram < ri.MinGram {
+		return nil, FormatError{fmt.Errorf("invalid n-gram lengths %d to %d", ri.MinGram, ri.MaxGram)}
+	}
+	if ri.Backend == BackendLocal && (ri.MinGram != 3 || ri.MaxGram != 3) {
+		return nil, FormatError{fmt.Errorf("the %s backend only supports trigrams", BackendLocal)}
+	}
+	switch cfg.ChatIndex.Backend {
+	case "", BackendElasticsearch, BackendSQLite:
+	default:
+		return nil, FormatError{fmt.Errorf("unknown chat backend %q", cfg.ChatIndex.Backend)}
+	}
 	return &cfg, nil
 }
 
@@ -0,0 +1,185 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// WithIndex returns a client for a different index on the same
+// server, sharing the configuration and bulk request limits of
+// client.
+func (client *Client) WithIndex(index string) *Client {
+	c := &Client{
+		Base:             client.Base,
+		Index:            index,
+		Auth:             client.Auth,
+		HTTPClient:       client.HTTPClient,
+		BulkMaxBytes:     client.BulkMaxBytes,
+		BulkMaxDocuments: client.BulkMaxDocuments,
+		MaxInflight:      client.MaxInflight,
+	}
+	c.limiter = client.bulkLimiter()
+	c.limiterOnce.Do(func() {})
+	client.versionMu.Lock()
+	c.version = client.version
+	client.versionMu.Unlock()
+	return c
+}
+
+// Meta returns the _meta field of the mapping of the client's index.
+// It returns nil if the mapping has no _meta field.
+func (client *Client) Meta() (map[string]json.RawMessage, error) {
+	req, err := http.NewRequest("GET", client.Base+"/"+client.Index+"/_mapping", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res map[string]struct {
+		Mappings map[string]json.RawMessage `json:"mappings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	for _, idx := range res {
+		mappings := idx.Mappings
+		if typed, ok := mappings["_doc"]; ok {
+			mappings = nil
+			if err := json.Unmarshal(typed, &mappings); err != nil {
+				return nil, err
+			}
+		}
+		var meta map[string]json.RawMessage
+		if b, ok := mappings["_meta"]; ok {
+			if err := json.Unmarshal(b, &meta); err != nil {
+				return nil, err
+			}
+		}
+		return meta, nil
+	}
+	return nil, nil
+}
+
+// AliasTarget returns the name of the index the client's index name
+// is an alias for, or the empty string if it isn't an alias.
+func (client *Client) AliasTarget() (string, error) {
+	req, err := http.NewRequest("GET", client.Base+"/_cat/aliases/"+url.PathEscape(client.Index)+"?format=json", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res []struct {
+		Alias string `json:"alias"`
+		Index string `json:"index"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	for _, a := range res {
+		if a.Alias == client.Index {
+			return a.Index, nil
+		}
+	}
+	return "", nil
+}
+
+// AliasAction is a single change to aliases.
+type AliasAction struct {
+	// One of "add", "remove" or "remove_index".
+	Type  string
+	Index string
+	Alias string
+}
+
+func (a AliasAction) MarshalJSON() ([]byte, error) {
+	args := map[string]string{"index": a.Index}
+	if a.Alias != "" {
+		args["alias"] = a.Alias
+	}
+	return json.Marshal(map[string]interface{}{a.Type: args})
+}
+
+// UpdateAliases applies all actions atomically.
+func (client *Client) UpdateAliases(actions ...AliasAction) error {
+	b, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", client.Base+"/_aliases", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// BlockWrites makes the named index read-only, or writable again.
+func (client *Client) BlockWrites(name string, block bool) error {
+	b, err := json.Marshal(map[string]bool{"index.blocks.write": block})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", client.Base+"/"+url.PathEscape(name)+"/_settings", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteIndex deletes the named index.
+func (client *Client) DeleteIndex(name string) error {
+	req, err := http.NewRequest("DELETE", client.Base+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Reindex copies all documents of the client's index to dst.
+func (client *Client) Reindex(dst string) (*ByQueryResponse, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"source": map[string]string{"index": client.Index},
+		"dest":   map[string]string{"index": dst},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", client.Base+"/_reindex?refresh=true", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var stats ByQueryResponse
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return &stats, err
+}
@@ -0,0 +1,69 @@
+package es
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	tests := []struct {
+		resp string
+		want string
+	}{
+		{`{"files_v1": {"mappings": {"_meta": {"idxgrep_schema": 1}, "properties": {}}}}`, `1`},
+		{`{"files": {"mappings": {"_doc": {"_meta": {"idxgrep_schema": 2}, "properties": {}}}}}`, `2`},
+		{`{"files": {"mappings": {"_doc": {"properties": {}}}}}`, ``},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(tt.resp))
+		}))
+		client := &Client{Base: srv.URL, Index: "files"}
+		meta, err := client.Meta()
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %s", tt.resp, err)
+			continue
+		}
+		if got := string(meta["idxgrep_schema"]); got != tt.want {
+			t.Errorf("%s: got schema %q, want %q", tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestAliasAction(t *testing.T) {
+	actions := []AliasAction{
+		{Type: "add", Index: "files_v2", Alias: "files"},
+		{Type: "remove_index", Index: "files"},
+	}
+	b, err := json.Marshal(actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"add":{"alias":"files","index":"files_v2"}},{"remove_index":{"index":"files"}}]`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestBlockWrites(t *testing.T) {
+	var method, path string
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"acknowledged": true}`))
+	}))
+	defer srv.Close()
+	client := &Client{Base: srv.URL, Index: "files"}
+	if err := client.BlockWrites("files_v1", true); err != nil {
+		t.Fatal(err)
+	}
+	if method != "PUT" || path != "/files_v1/_settings" || body["index.blocks.write"] != true {
+		t.Errorf("got %s %s %v, want PUT /files_v1/_settings blocking writes", method, path, body)
+	}
+}
@@ -1,120 +1,226 @@
 package es
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
-	"io"
+	"fmt"
+	"log"
 	"net/http"
+	"time"
 )
 
+const (
+	bulkMaxBytes       = 1024 * 1024 * 8
+	bulkMaxDocuments   = 5000
+	defaultMaxInflight = 4
+	bulkMaxRetries     = 8
+	bulkBackoff        = 100 * time.Millisecond
+)
+
+// BulkIndexer indexes documents in batches. Documents that
+// Elasticsearch rejects because it is overloaded are retried, other
+// failures are reported per document and don't stop indexing.
 type BulkIndexer struct {
-	client *Client
-	w      io.WriteCloser
-	done   chan error
-	size   int
+	// OnFailure, if set, gets called for every document that
+	// couldn't be indexed. By default, failures are logged.
+	OnFailure func(BulkFailure)
 
-	url string
+	// Number of documents that have been indexed, or deleted,
+	// successfully and that have failed.
+	Indexed int
+	Failed  int
+
+	client   *Client
+	maxBytes int
+	maxDocs  int
+	buf      []byte
+	items    []bulkItem
 }
 
-type bulkResult struct {
-	Errors bool
-	// TODO(dh): store the items. each item may have different fields,
-	// depending on the op.
+type bulkItem struct {
+	id  string
+	obj interface{}
+	// location of the item's lines in the request body
+	start, end int
 }
 
-func (bi *BulkIndexer) reset() error {
-	pr, pw := io.Pipe()
-	done := make(chan error, 1)
-	req, err := http.NewRequest("POST", bi.url, pr)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/x-ndjson")
+// BulkFailure describes a document that couldn't be indexed.
+type BulkFailure struct {
+	ID string
+	// The document as passed to Index.
+	Object interface{}
+	Status int
+	Err    Error
+}
 
-	bi.w = pw
-	bi.done = done
-	bi.size = 0
+func (f BulkFailure) Error() string {
+	return fmt.Sprintf("status code %d - %s: %s", f.Status, f.Err.Type, f.Err.Reason)
+}
 
-	go func() {
-		resp, err := bi.client.Do(req)
-		if err != nil {
-			done <- err
-			return
-		}
-		defer resp.Body.Close()
-		var res bulkResult
-		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-			done <- err
-			return
-		}
-		if res.Errors {
-			done <- errors.New("bulk insert encountered error")
-			return
-		}
-		close(done)
-	}()
+type bulkResult struct {
+	Errors bool `json:"errors"`
+	// Each item is an object with a single key, the name of the
+	// operation.
+	Items []map[string]bulkItemResult `json:"items"`
+}
 
-	return nil
+type bulkItemResult struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *Error `json:"error"`
 }
 
-func (bi *BulkIndexer) Index(obj interface{}, id string) error {
-	if bi.done == nil {
-		if err := bi.reset(); err != nil {
-			return err
+// rejected reports whether any item was rejected because
+// Elasticsearch is overloaded.
+func (res bulkResult) rejected() bool {
+	for _, op := range res.Items {
+		for _, r := range op {
+			if r.Error != nil && retryableStatus(r.Status) {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+}
 
+func (bi *BulkIndexer) Index(obj interface{}, id string) error {
 	b, err := json.Marshal(obj)
 	if err != nil {
 		return err
 	}
-	type tHdr struct {
-		Index struct {
-			ID string `json:"_id,omitempty"`
-		} `json:"index"`
+	return bi.add("index", id, obj, b)
+}
+
+// Delete deletes the document with the given ID. Deleting a document
+// that doesn't exist isn't a failure.
+func (bi *BulkIndexer) Delete(id string) error {
+	return bi.add("delete", id, nil, nil)
+}
+
+// add buffers an action on the document with the given ID. body is
+// the action's source line, if it has one.
+func (bi *BulkIndexer) add(action string, id string, obj interface{}, body []byte) error {
+	type tMeta struct {
+		ID string `json:"_id,omitempty"`
 	}
-	hdr := tHdr{}
-	hdr.Index.ID = id
-	bhdr, err := json.Marshal(hdr)
+	bhdr, err := json.Marshal(map[string]tMeta{action: {ID: id}})
 	if err != nil {
 		panic(err)
 	}
-	if _, err := bi.w.Write(bhdr); err != nil {
-		return err
-	}
-	if _, err := bi.w.Write([]byte{'\n'}); err != nil {
-		return err
-	}
-	if _, err := bi.w.Write(b); err != nil {
-		return err
-	}
-	if _, err := bi.w.Write([]byte{'\n'}); err != nil {
-		return err
+
+	start := len(bi.buf)
+	bi.buf = append(bi.buf, bhdr...)
+	bi.buf = append(bi.buf, '\n')
+	if body != nil {
+		bi.buf = append(bi.buf, body...)
+		bi.buf = append(bi.buf, '\n')
 	}
+	bi.items = append(bi.items, bulkItem{id, obj, start, len(bi.buf)})
 
-	bi.size += len(b)
-	if bi.size > 1024*1024*8 {
+	if len(bi.buf) >= bi.maxBytes || len(bi.items) >= bi.maxDocs {
 		return bi.Flush()
 	}
 	return nil
 }
 
-func (bi *BulkIndexer) Close() error {
-	if bi.done == nil {
-		return nil
+func (bi *BulkIndexer) send(body []byte) (bulkResult, error) {
+	var res bulkResult
+	typ, err := bi.client.typePath()
+	if err != nil {
+		return res, err
 	}
-	if _, err := bi.w.Write([]byte{'\n'}); err != nil {
-		_ = bi.w.Close()
-		return err
+	url := bi.client.Base + "/" + bi.client.Index + typ + "/_bulk"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return res, err
 	}
-	if err := bi.w.Close(); err != nil {
-		return err
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := bi.client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+func (bi *BulkIndexer) fail(f BulkFailure) {
+	bi.Failed++
+	if bi.OnFailure != nil {
+		bi.OnFailure(f)
+		return
 	}
-	err := <-bi.done
-	bi.done = nil
-	return err
+	log.Printf("Couldn't index document %s: %s", f.ID, f)
 }
 
+// Flush sends all buffered documents. It only returns an error if
+// the request as a whole failed.
 func (bi *BulkIndexer) Flush() error {
-	return bi.Close()
+	defer func() {
+		bi.buf = bi.buf[:0]
+		bi.items = bi.items[:0]
+	}()
+	body := bi.buf
+	items := bi.items
+	backoff := bulkBackoff
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		l := bi.client.bulkLimiter()
+		l.acquire()
+		res, err := bi.send(body)
+		if err != nil {
+			apiErr, ok := err.(APIError)
+			rejected := ok && retryableStatus(apiErr.Code)
+			l.release(rejected)
+			if rejected && attempt < bulkMaxRetries {
+				continue
+			}
+			return err
+		}
+		l.release(res.Errors && res.rejected())
+		if !res.Errors {
+			bi.Indexed += len(items)
+			break
+		}
+		if len(res.Items) != len(items) {
+			return fmt.Errorf("bulk response has %d items, expected %d", len(res.Items), len(items))
+		}
+
+		var retryBody []byte
+		var retryItems []bulkItem
+		for i, op := range res.Items {
+			item := items[i]
+			for _, r := range op {
+				switch {
+				case r.Error == nil:
+					bi.Indexed++
+				case retryableStatus(r.Status) && attempt < bulkMaxRetries:
+					start := len(retryBody)
+					retryBody = append(retryBody, body[item.start:item.end]...)
+					retryItems = append(retryItems, bulkItem{item.id, item.obj, start, len(retryBody)})
+				default:
+					bi.fail(BulkFailure{
+						ID:     item.id,
+						Object: item.obj,
+						Status: r.Status,
+						Err:    *r.Error,
+					})
+				}
+			}
+		}
+		body = retryBody
+		items = retryItems
+	}
+	return nil
+}
+
+func (bi *BulkIndexer) Close() error {
+	return bi.Flush()
 }
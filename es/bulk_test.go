@@ -0,0 +1,54 @@
+package es
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBulkDelete(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/" {
+			w.Write([]byte(`{"version": {"number": "7.17.9"}}`))
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Write([]byte(`{"errors": true, "items": [
+			{"index": {"_id": "1", "status": 201}},
+			{"delete": {"_id": "2", "status": 404}},
+			{"delete": {"_id": "3", "status": 400, "error": {"type": "bad", "reason": "no"}}}
+		]}`))
+	}))
+	defer srv.Close()
+
+	client := &Client{Base: srv.URL, Index: "idx"}
+	bi := client.BulkInsert()
+	var failed []string
+	bi.OnFailure = func(f BulkFailure) { failed = append(failed, f.ID) }
+	if err := bi.Index(map[string]string{"a": "b"}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"2", "3"} {
+		if err := bi.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"index":{"_id":"1"}}` + "\n" + `{"a":"b"}` + "\n" +
+		`{"delete":{"_id":"2"}}` + "\n" +
+		`{"delete":{"_id":"3"}}` + "\n"
+	if body != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+	// Deleting a missing document isn't a failure.
+	if bi.Indexed != 2 || bi.Failed != 1 || len(failed) != 1 || failed[0] != "3" {
+		t.Errorf("got %d succeeded, %d failed (%q), want 2 and 1 (document 3)", bi.Indexed, bi.Failed, failed)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 )
 
@@ -27,6 +29,23 @@ type APIError struct {
 type Client struct {
 	Base  string
 	Index string
+	Auth  Auth
+	// HTTPClient is used for all requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Limits for bulk requests. Zero values select the defaults.
+	BulkMaxBytes     int
+	BulkMaxDocuments int
+	// Maximum number of bulk requests in flight, shared by all
+	// BulkIndexers of this client.
+	MaxInflight int
+
+	limiterOnce sync.Once
+	limiter     *limiter
+
+	versionMu sync.Mutex
+	version   *Version
 }
 
 func (err APIError) Error() string {
@@ -34,7 +53,12 @@ func (err APIError) Error() string {
 }
 
 func (client *Client) Do(req *http.Request) (*http.Response, error) {
-	resp, err := http.DefaultClient.Do(req)
+	client.Auth.apply(req)
+	hc := client.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -53,14 +77,31 @@ func (client *Client) Do(req *http.Request) (*http.Response, error) {
 }
 
 func (client *Client) BulkInsert() *BulkIndexer {
-	url := fmt.Sprintf("%s/%s/_doc/_bulk", client.Base, client.Index)
 	bi := &BulkIndexer{
-		client: client,
-		url:    url,
+		client:   client,
+		maxBytes: client.BulkMaxBytes,
+		maxDocs:  client.BulkMaxDocuments,
+	}
+	if bi.maxBytes <= 0 {
+		bi.maxBytes = bulkMaxBytes
+	}
+	if bi.maxDocs <= 0 {
+		bi.maxDocs = bulkMaxDocuments
 	}
 	return bi
 }
 
+func (client *Client) bulkLimiter() *limiter {
+	client.limiterOnce.Do(func() {
+		n := client.MaxInflight
+		if n <= 0 {
+			n = defaultMaxInflight
+		}
+		client.limiter = newLimiter(n)
+	})
+	return client.limiter
+}
+
 type ByQueryResponse struct {
 	// Amount of time from start to end of the whole operation
 	Took time.Duration
@@ -71,6 +112,10 @@ type ByQueryResponse struct {
 	Total int
 	// The number of documents that were successfully deleted.
 	Deleted int
+	// The number of documents that were successfully created and
+	// updated by a reindex.
+	Created int
+	Updated int
 	// The number of scroll responses pulled back by the delete by query.
 	Batches int
 	// The number of version conflicts that the delete by query hit.
@@ -89,7 +134,15 @@ type ByQueryResponse struct {
 	// the delete by query.
 	RequestsPerSecond float64
 	ThrottledUntil    time.Time
-	Failures          []string
+	Failures          []ByQueryFailure
+}
+
+// ByQueryFailure describes a document that couldn't be processed.
+type ByQueryFailure struct {
+	Index  string `json:"index"`
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Cause  Error  `json:"cause"`
 }
 
 func (q *ByQueryResponse) UnmarshalJSON(b []byte) error {
@@ -98,6 +151,8 @@ func (q *ByQueryResponse) UnmarshalJSON(b []byte) error {
 		TimedOut         bool `json:"timed_out"`
 		Total            int  `json:"total"`
 		Deleted          int  `json:"deleted"`
+		Created          int  `json:"created"`
+		Updated          int  `json:"updated"`
 		Batches          int  `json:"batches"`
 		VersionConflicts int  `json:"version_conflicts"`
 		Noops            int  `json:"noops"`
@@ -105,10 +160,10 @@ func (q *ByQueryResponse) UnmarshalJSON(b []byte) error {
 			Bulk   int `json:"bulk"`
 			Search int `json:"search"`
 		} `json:"retries"`
-		Throttled         int      `json:"throttled"`
-		RequestsPerSecond float64  `json:"requests_per_second"`
-		ThrottledUntil    int      `json:"throttled_until"`
-		Failures          []string `json:"failures"`
+		Throttled         int              `json:"throttled"`
+		RequestsPerSecond float64          `json:"requests_per_second"`
+		ThrottledUntil    int              `json:"throttled_until"`
+		Failures          []ByQueryFailure `json:"failures"`
 	}
 	err := json.Unmarshal(b, &resp)
 	if err != nil {
@@ -119,6 +174,8 @@ func (q *ByQueryResponse) UnmarshalJSON(b []byte) error {
 		TimedOut:         resp.TimedOut,
 		Total:            resp.Total,
 		Deleted:          resp.Deleted,
+		Created:          resp.Created,
+		Updated:          resp.Updated,
 		Batches:          resp.Batches,
 		VersionConflicts: resp.VersionConflicts,
 		Noops:            resp.Noops,
@@ -157,3 +214,21 @@ func (client *Client) DeleteByQuery(q interface{}) (*ByQueryResponse, error) {
 	err = json.NewDecoder(resp.Body).Decode(&stats)
 	return &stats, err
 }
+
+// Delete deletes a single document. Deleting a document that doesn't
+// exist is not an error.
+func (client *Client) Delete(id string) error {
+	req, err := http.NewRequest("DELETE", client.Base+"/"+client.Index+"/_doc/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if err, ok := err.(APIError); ok && err.Code == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,46 @@
+package es
+
+import "sync"
+
+// limiter bounds the number of concurrent bulk requests. The limit
+// follows an additive-increase/multiplicative-decrease scheme: it is
+// halved whenever Elasticsearch rejects a request because it is
+// overloaded, and grows by one for every request that went through,
+// up to max.
+type limiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	max      int
+	limit    int
+	inflight int
+}
+
+func newLimiter(max int) *limiter {
+	l := &limiter{max: max, limit: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	for l.inflight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inflight++
+	l.mu.Unlock()
+}
+
+func (l *limiter) release(rejected bool) {
+	l.mu.Lock()
+	l.inflight--
+	if rejected {
+		l.limit /= 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+	} else if l.limit < l.max {
+		l.limit++
+	}
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
@@ -5,16 +5,38 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 type Search struct {
 	Query  interface{} `json:"query"`
 	Fields []string    `json:"stored_fields,omitempty"`
+	Sort   []Sort      `json:"sort,omitempty"`
+	// SearchAfter returns the hits following the given sort values.
+	SearchAfter []interface{} `json:"search_after,omitempty"`
+	// SeqNo returns the sequence number of each hit.
+	SeqNo bool `json:"seq_no_primary_term,omitempty"`
+}
+
+// Sort sorts hits by a field.
+type Sort struct {
+	Key  string
+	Desc bool
+}
+
+func (s Sort) MarshalJSON() ([]byte, error) {
+	order := "asc"
+	if s.Desc {
+		order = "desc"
+	}
+	return json.Marshal(map[string]string{s.Key: order})
 }
 
 type BoolQuery struct {
 	And       []interface{}
 	Or        []interface{}
+	Filter    []interface{}
 	MinimumOr int
 }
 
@@ -22,6 +44,7 @@ func (q BoolQuery) MarshalJSON() ([]byte, error) {
 	qq := struct {
 		And       []interface{} `json:"must,omitempty"`
 		Or        []interface{} `json:"should,omitempty"`
+		Filter    []interface{} `json:"filter,omitempty"`
 		MinimumOr int           `json:"minimum_should_match"`
 	}(q)
 	v := struct {
@@ -51,6 +74,49 @@ func (t Term) MarshalJSON() ([]byte, error) {
 	return json.Marshal(v)
 }
 
+type Wildcard struct {
+	Key   string
+	Value string
+}
+
+func (w Wildcard) MarshalJSON() ([]byte, error) {
+	type value struct {
+		Value string `json:"value"`
+	}
+
+	v := struct {
+		Wildcard map[string]value `json:"wildcard"`
+	}{
+		map[string]value{w.Key: value{w.Value}},
+	}
+
+	return json.Marshal(v)
+}
+
+// Range matches values in a range. Nil bounds are omitted.
+type Range struct {
+	Key string
+	GT  interface{}
+	GTE interface{}
+	LT  interface{}
+	LTE interface{}
+}
+
+func (r Range) MarshalJSON() ([]byte, error) {
+	type bounds struct {
+		GT  interface{} `json:"gt,omitempty"`
+		GTE interface{} `json:"gte,omitempty"`
+		LT  interface{} `json:"lt,omitempty"`
+		LTE interface{} `json:"lte,omitempty"`
+	}
+	v := struct {
+		Range map[string]bounds `json:"range"`
+	}{
+		map[string]bounds{r.Key: {r.GT, r.GTE, r.LT, r.LTE}},
+	}
+	return json.Marshal(v)
+}
+
 type Match struct {
 	Key   string
 	Value interface{}
@@ -75,12 +141,33 @@ type SearchHit struct {
 	Type   string          `json:"_type"`
 	ID     string          `json:"_id"`
 	Score  float64         `json:"_score"`
+	SeqNo  int64           `json:"_seq_no"`
 	Source json.RawMessage `json:"_source"`
 	Fields json.RawMessage `json:"fields"`
 }
 
+// Total is the total number of hits of a search. Elasticsearch 7
+// and later may only count hits up to a limit, in which case Relation
+// is "gte".
+type Total struct {
+	Value    int    `json:"value"`
+	Relation string `json:"relation"`
+}
+
+// UnmarshalJSON decodes both the plain number used by Elasticsearch 6
+// and the object used by later versions.
+func (t *Total) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '{' {
+		type total Total
+		return json.Unmarshal(b, (*total)(t))
+	}
+	t.Relation = "eq"
+	return json.Unmarshal(b, &t.Value)
+}
+
 type searchHits struct {
-	Hits []SearchHit `json:"hits"`
+	Total Total       `json:"total"`
+	Hits  []SearchHit `json:"hits"`
 }
 
 type searchResult struct {
@@ -116,3 +203,188 @@ func (client *Client) Search(s Search, count int) ([]SearchHit, error) {
 	}
 	return res.Hits.Hits, nil
 }
+
+// Get returns the stored fields of the document with the given ID.
+// found is false if there is no such document.
+func (client *Client) Get(id string, fields []string) (hit SearchHit, found bool, err error) {
+	u := client.Base + "/" + client.Index + "/_doc/" + url.PathEscape(id) +
+		"?stored_fields=" + url.QueryEscape(strings.Join(fields, ","))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return SearchHit{}, false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if err, ok := err.(APIError); ok && err.Code == http.StatusNotFound {
+			return SearchHit{}, false, nil
+		}
+		return SearchHit{}, false, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		SearchHit
+		Found bool `json:"found"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res.SearchHit, res.Found, err
+}
+
+// Count returns the number of documents matching the query q.
+func (client *Client) Count(q interface{}) (int, error) {
+	b, err := json.Marshal(map[string]interface{}{"query": q})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", client.Base+"/"+client.Index+"/_count", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		if err, ok := err.(APIError); ok {
+			if err.Err.Type == "index_not_found_exception" {
+				return 0, nil
+			}
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Count int `json:"count"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res.Count, err
+}
+
+// FilterCounts returns the number of documents matching each of the
+// named filters, as well as the total number of documents in the
+// index, using a single filters aggregation.
+func (client *Client) FilterCounts(filters map[string]interface{}) (counts map[string]int, total int, err error) {
+	body := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"counts": map[string]interface{}{
+				"filters": map[string]interface{}{"filters": filters},
+			},
+		},
+	}
+	v, err := client.Version()
+	if err != nil {
+		return nil, 0, err
+	}
+	if v.Typeless() {
+		body["track_total_hits"] = true
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest("POST", client.Base+"/"+client.Index+"/_search", bytes.NewReader(b))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		if err, ok := err.(APIError); ok {
+			if err.Err.Type == "index_not_found_exception" {
+				return map[string]int{}, 0, nil
+			}
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Hits         searchHits `json:"hits"`
+		Aggregations struct {
+			Counts struct {
+				Buckets map[string]struct {
+					DocCount int `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"counts"`
+		} `json:"aggregations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, 0, err
+	}
+	counts = make(map[string]int, len(filters))
+	for name, bucket := range res.Aggregations.Counts.Buckets {
+		counts[name] = bucket.DocCount
+	}
+	return counts, res.Hits.Total.Value, nil
+}
+
+type scrollResult struct {
+	ScrollID string     `json:"_scroll_id"`
+	Hits     searchHits `json:"hits"`
+}
+
+func (client *Client) scroll(req *http.Request) (scrollResult, error) {
+	req.Header.Set("Content-Type", "application/json")
+	var res scrollResult
+	resp, err := client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// Scroll calls fn for every document matching s, retrieving size
+// documents at a time. Unlike Search, it isn't limited in the number
+// of documents it can return.
+func (client *Client) Scroll(s Search, size int, fn func(SearchHit) error) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/_search?scroll=1m&size=%d", client.Base, client.Index, size), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res, err := client.scroll(req)
+	if err != nil {
+		if err, ok := err.(APIError); ok {
+			if err.Err.Type == "index_not_found_exception" {
+				return nil
+			}
+		}
+		return err
+	}
+	id := res.ScrollID
+	defer func() {
+		b, _ := json.Marshal(map[string]string{"scroll_id": id})
+		req, err := http.NewRequest("DELETE", client.Base+"/_search/scroll", bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	for len(res.Hits.Hits) > 0 {
+		for _, hit := range res.Hits.Hits {
+			if err := fn(hit); err != nil {
+				return err
+			}
+		}
+		b, err := json.Marshal(map[string]string{"scroll": "1m", "scroll_id": id})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", client.Base+"/_search/scroll", bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		res, err = client.scroll(req)
+		if err != nil {
+			return err
+		}
+		id = res.ScrollID
+	}
+	return nil
+}
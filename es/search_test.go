@@ -0,0 +1,38 @@
+package es
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	var gotURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		gotURL = r.URL.String()
+		if r.URL.Path != "/idx/_doc/a b" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"_index": "idx", "_id": "missing", "found": false}`))
+			return
+		}
+		w.Write([]byte(`{"_index": "idx", "_id": "a b", "found": true, "fields": {"content": ["eA=="]}}`))
+	}))
+	defer srv.Close()
+
+	client := &Client{Base: srv.URL, Index: "idx"}
+	hit, found, err := client.Get("a b", []string{"content", "name"})
+	if err != nil || !found {
+		t.Fatalf("Get() = %v, %v, want a document", found, err)
+	}
+	if want := "/idx/_doc/a%20b?stored_fields=content%2Cname"; gotURL != want {
+		t.Errorf("requested %s, want %s", gotURL, want)
+	}
+	if hit.ID != "a b" || string(hit.Fields) != `{"content": ["eA=="]}` {
+		t.Errorf("got hit %q with fields %s", hit.ID, hit.Fields)
+	}
+
+	if _, found, err := client.Get("missing", nil); err != nil || found {
+		t.Errorf("Get() of a missing document = %v, %v, want not found", found, err)
+	}
+}
@@ -0,0 +1,97 @@
+package es
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Auth holds the credentials sent with every request. At most one
+// method should be configured.
+type Auth struct {
+	Username string
+	Password string
+	// APIKey is either the base64 encoded "id:api_key" pair returned
+	// by Elasticsearch, or the pair itself.
+	APIKey      string
+	BearerToken string
+}
+
+func (auth Auth) apply(req *http.Request) {
+	switch {
+	case auth.Username != "":
+		req.SetBasicAuth(auth.Username, auth.Password)
+	case auth.APIKey != "":
+		key := auth.APIKey
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		req.Header.Set("Authorization", "ApiKey "+key)
+	case auth.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+auth.BearerToken)
+	}
+}
+
+// TransportOptions configure the HTTP client used to talk to
+// Elasticsearch.
+type TransportOptions struct {
+	// PEM encoded CA bundle used to verify the server, in addition
+	// to the system's roots.
+	CACert string
+	// PEM encoded client certificate and key.
+	ClientCert string
+	ClientKey  string
+	// Don't verify the server's certificate.
+	Insecure bool
+	// Timeout for whole requests. Zero means no timeout.
+	Timeout time.Duration
+	// URL of an HTTP proxy. If empty, the usual environment
+	// variables are used.
+	Proxy string
+}
+
+// NewHTTPClient returns an HTTP client configured according to opts.
+func NewHTTPClient(opts TransportOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if opts.CACert != "" {
+		b, err := ioutil.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		if opts.ClientCert == "" || opts.ClientKey == "" {
+			return nil, errors.New("client certificate and key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport, Timeout: opts.Timeout}, nil
+}
@@ -0,0 +1,170 @@
+package es
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientCert creates a self-signed client certificate and writes it
+// and its key to dir.
+func clientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idxgrep"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return cert, certFile, keyFile
+}
+
+func TestTransport(t *testing.T) {
+	dir := t.TempDir()
+	cert, certFile, keyFile := clientCert(t, dir)
+
+	var gotAuth string
+	var gotCert bool
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotCert = len(r.TLS.PeerCertificates) > 0
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"count": 42}`))
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+
+	tests := []struct {
+		name string
+		opts TransportOptions
+		auth Auth
+		// expected Authorization header
+		header string
+		cert   bool
+		err    bool
+	}{
+		{name: "untrusted", err: true},
+		{name: "insecure", opts: TransportOptions{Insecure: true}},
+		{name: "ca", opts: TransportOptions{CACert: caFile}},
+		{
+			name:   "basic",
+			opts:   TransportOptions{CACert: caFile},
+			auth:   Auth{Username: "elastic", Password: "secret"},
+			header: "Basic ZWxhc3RpYzpzZWNyZXQ=",
+		},
+		{
+			name:   "api key pair",
+			opts:   TransportOptions{CACert: caFile},
+			auth:   Auth{APIKey: "id:key"},
+			header: "ApiKey aWQ6a2V5",
+		},
+		{
+			name:   "encoded api key",
+			opts:   TransportOptions{CACert: caFile},
+			auth:   Auth{APIKey: "aWQ6a2V5"},
+			header: "ApiKey aWQ6a2V5",
+		},
+		{
+			name:   "bearer",
+			opts:   TransportOptions{CACert: caFile},
+			auth:   Auth{BearerToken: "token"},
+			header: "Bearer token",
+		},
+		{
+			name: "client certificate",
+			opts: TransportOptions{CACert: caFile, ClientCert: certFile, ClientKey: keyFile},
+			cert: true,
+		},
+	}
+	for _, tt := range tests {
+		gotAuth, gotCert = "", false
+		hc, err := NewHTTPClient(tt.opts)
+		if err != nil {
+			t.Errorf("%s: NewHTTPClient: %s", tt.name, err)
+			continue
+		}
+		client := &Client{Base: srv.URL, Index: "test", Auth: tt.auth, HTTPClient: hc}
+		n, err := client.Count(nil)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Count: %s", tt.name, err)
+			continue
+		}
+		if n != 42 {
+			t.Errorf("%s: got count %d, want 42", tt.name, n)
+		}
+		if gotAuth != tt.header {
+			t.Errorf("%s: got Authorization %q, want %q", tt.name, gotAuth, tt.header)
+		}
+		if gotCert != tt.cert {
+			t.Errorf("%s: got client certificate %t, want %t", tt.name, gotCert, tt.cert)
+		}
+	}
+}
+
+func TestTransportOptionsErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, _ := clientCert(t, dir)
+	bad := []TransportOptions{
+		{CACert: filepath.Join(dir, "missing.pem")},
+		{CACert: filepath.Join(dir, "client-key.pem")},
+		{ClientCert: certFile},
+		{Proxy: "://"},
+	}
+	for _, opts := range bad {
+		if _, err := NewHTTPClient(opts); err == nil {
+			t.Errorf("NewHTTPClient(%+v) succeeded, expected error", opts)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	Elasticsearch = "elasticsearch"
+	OpenSearch    = "opensearch"
+)
+
+// Version describes the server a client talks to.
+type Version struct {
+	// Either Elasticsearch or OpenSearch.
+	Distribution string
+	Number       string
+	Major        int
+	Minor        int
+}
+
+func (v Version) String() string {
+	return v.Distribution + " " + v.Number
+}
+
+// Typeless reports whether the server has done away with mapping
+// types. This is the case for Elasticsearch 7 and later, and for all
+// versions of OpenSearch.
+func (v Version) Typeless() bool {
+	return v.Distribution == OpenSearch || v.Major >= 7
+}
+
+func parseVersion(distribution, number string) (Version, error) {
+	if distribution == "" {
+		distribution = Elasticsearch
+	}
+	v := Version{Distribution: distribution, Number: number}
+	parts := strings.SplitN(number, ".", 3)
+	if len(parts) < 2 {
+		return v, fmt.Errorf("invalid version number %q", number)
+	}
+	var err error
+	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return v, fmt.Errorf("invalid version number %q", number)
+	}
+	if v.Minor, err = strconv.Atoi(parts[1]); err != nil {
+		return v, fmt.Errorf("invalid version number %q", number)
+	}
+	return v, nil
+}
+
+// Version returns the version of the server. It is detected on first
+// use and cached afterwards.
+func (client *Client) Version() (Version, error) {
+	client.versionMu.Lock()
+	defer client.versionMu.Unlock()
+	if client.version != nil {
+		return *client.version, nil
+	}
+	req, err := http.NewRequest("GET", client.Base+"/", nil)
+	if err != nil {
+		return Version{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Version{}, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return Version{}, err
+	}
+	v, err := parseVersion(res.Version.Distribution, res.Version.Number)
+	if err != nil {
+		return Version{}, err
+	}
+	client.version = &v
+	return v, nil
+}
+
+// typePath returns the path segment that names the mapping type, for
+// servers that still have mapping types.
+func (client *Client) typePath() (string, error) {
+	v, err := client.Version()
+	if err != nil {
+		return "", err
+	}
+	if v.Typeless() {
+		return "", nil
+	}
+	return "/_doc", nil
+}
+
+// CreateIndex creates the named index with the given aliases.
+// mappings describes the document's fields and is wrapped in a
+// mapping type when the server requires one.
+func (client *Client) CreateIndex(name string, settings, mappings json.RawMessage, aliases ...string) error {
+	v, err := client.Version()
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"settings": settings,
+		"mappings": mappings,
+	}
+	if !v.Typeless() {
+		body["mappings"] = map[string]interface{}{"_doc": mappings}
+	}
+	if len(aliases) > 0 {
+		m := map[string]struct{}{}
+		for _, alias := range aliases {
+			m[alias] = struct{}{}
+		}
+		body["aliases"] = m
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", client.Base+"/"+url.PathEscape(name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PutMapping adds fields to the mapping of the client's index.
+func (client *Client) PutMapping(mapping json.RawMessage) error {
+	typ, err := client.typePath()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", client.Base+"/"+client.Index+"/_mapping"+typ, bytes.NewReader(mapping))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,120 @@
+package es
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		distribution string
+		number       string
+		want         Version
+		typeless     bool
+	}{
+		{"", "6.8.23", Version{Elasticsearch, "6.8.23", 6, 8}, false},
+		{"", "7.17.9", Version{Elasticsearch, "7.17.9", 7, 17}, true},
+		{"", "8.11.0-SNAPSHOT", Version{Elasticsearch, "8.11.0-SNAPSHOT", 8, 11}, true},
+		{"opensearch", "1.3.0", Version{OpenSearch, "1.3.0", 1, 3}, true},
+		{"opensearch", "2.11.1", Version{OpenSearch, "2.11.1", 2, 11}, true},
+	}
+	for _, tt := range tests {
+		v, err := parseVersion(tt.distribution, tt.number)
+		if err != nil {
+			t.Errorf("parseVersion(%q, %q): %s", tt.distribution, tt.number, err)
+			continue
+		}
+		if v != tt.want {
+			t.Errorf("parseVersion(%q, %q) = %+v, want %+v", tt.distribution, tt.number, v, tt.want)
+		}
+		if v.Typeless() != tt.typeless {
+			t.Errorf("%s: Typeless() = %t, want %t", v, v.Typeless(), tt.typeless)
+		}
+	}
+	for _, number := range []string{"", "7", "x.1.0"} {
+		if _, err := parseVersion("", number); err == nil {
+			t.Errorf("parseVersion(%q) succeeded, expected error", number)
+		}
+	}
+}
+
+func TestTotal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Total
+	}{
+		{`12`, Total{12, "eq"}},
+		{`{"value": 10000, "relation": "gte"}`, Total{10000, "gte"}},
+	}
+	for _, tt := range tests {
+		var got Total
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVersionURLs(t *testing.T) {
+	tests := []struct {
+		root    string
+		bulk    string
+		mapping string
+		typed   bool
+	}{
+		{`{"version": {"number": "6.8.23"}}`, "/idx/_doc/_bulk", "/idx/_mapping/_doc", true},
+		{`{"version": {"number": "7.17.9"}}`, "/idx/_bulk", "/idx/_mapping", false},
+		{`{"version": {"number": "8.11.0"}}`, "/idx/_bulk", "/idx/_mapping", false},
+		{`{"version": {"distribution": "opensearch", "number": "2.11.1"}}`, "/idx/_bulk", "/idx/_mapping", false},
+	}
+	for _, tt := range tests {
+		var paths []string
+		var created map[string]json.RawMessage
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/":
+				w.Write([]byte(tt.root))
+				return
+			case "/idx":
+				b, _ := ioutil.ReadAll(r.Body)
+				json.Unmarshal(b, &created)
+			}
+			paths = append(paths, r.URL.Path)
+			w.Write([]byte(`{"errors": false, "items": []}`))
+		}))
+
+		client := &Client{Base: srv.URL, Index: "idx"}
+		bi := client.BulkInsert()
+		if err := bi.Index(map[string]string{"a": "b"}, "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := bi.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.PutMapping(json.RawMessage(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.CreateIndex("idx", json.RawMessage(`{}`), json.RawMessage(`{"properties": {}}`)); err != nil {
+			t.Fatal(err)
+		}
+		srv.Close()
+
+		if len(paths) != 3 || paths[0] != tt.bulk || paths[1] != tt.mapping {
+			t.Errorf("%s: got requests %q, want %q and %q", tt.root, paths, tt.bulk, tt.mapping)
+		}
+		var mappings map[string]json.RawMessage
+		if err := json.Unmarshal(created["mappings"], &mappings); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := mappings["_doc"]; ok != tt.typed {
+			t.Errorf("%s: got mappings %s", tt.root, created["mappings"])
+		}
+	}
+}
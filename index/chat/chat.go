@@ -5,12 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
+	"math"
 	"path"
 	"regexp"
 	"strings"
 	"time"
 
+	"honnef.co/go/idxgrep/config"
 	"honnef.co/go/idxgrep/es"
 	"honnef.co/go/idxgrep/fs"
 	"honnef.co/go/idxgrep/index"
@@ -29,6 +30,22 @@ type Message struct {
 	From    string
 	To      []string
 	Message string
+
+	// pos orders messages with the same time. It is the row ID in
+	// SQLite and the sequence number in Elasticsearch, and is only
+	// known, as told by hasPos, for messages returned by a store.
+	pos    int64
+	hasPos bool
+}
+
+// bounds returns the positions to page from when looking for messages
+// before and after m that have the same time. If m's position isn't
+// known, no such messages are included.
+func (m Message) bounds() (before, after int64) {
+	if !m.hasPos {
+		return math.MinInt64, math.MaxInt64
+	}
+	return m.pos, m.pos
 }
 
 type message struct {
@@ -40,10 +57,15 @@ type message struct {
 	Message string   `json:"message"`
 }
 
+// millis returns t as milliseconds since the Unix epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 func (m *Message) MarshalJSON() ([]byte, error) {
 	msg := message{
 		Conversation: m.Conversation,
-		Time:         int(m.Time.UnixNano() / int64(time.Millisecond)),
+		Time:         int(millis(m.Time)),
 		From:         m.From,
 		To:           m.To,
 		Message:      m.Message,
@@ -78,134 +100,43 @@ func (m Message) String() string {
 
 type Index struct {
 	Client *es.Client
+	Config config.ChatIndex
+	// Store stores the messages. If nil, it is chosen according to
+	// Config.
+	Store Store
 }
 
 func (idx *Index) CreateIndex() error {
-	body := `
-    {
-      "settings": {
-        "number_of_shards": 1,
-        "number_of_replicas": 0,
-        "analysis": {
-          "filter": {
-            "shingles": {
-              "type": "shingle",
-              "min_shingle_size": 2,
-              "max_shingle_size": 2,
-              "output_unigrams": false
-            }
-          },
-          "char_filter": {
-            "username": {
-              "type": "pattern_replace",
-              "pattern": "^[+%@]?(.+)$",
-              "replacement": "$1"
-            }
-          },
-          "normalizer": {
-            "username": {
-              "type": "custom",
-              "char_filter": ["username"],
-              "filter": ["lowercase"]
-            }
-          },
-          "analyzer": {
-            "shingles": {
-              "type": "custom",
-              "tokenizer": "standard",
-              "filter": ["lowercase", "shingles"]
-            }
-          }
-        }
-      },
-      "mappings": {
-        "_doc": {
-          "properties": {
-            "protocol": {
-              "type": "keyword"
-            },
-            "server": {
-              "type": "keyword"
-            },
-            "channel_or_person": {
-              "type": "keyword"
-            },
-            "time": {
-              "type": "date",
-              "format": "epoch_millis"
-            },
-            "from": {
-              "type": "keyword",
-              "normalizer": "username",
-              "fields": {
-                "raw": {
-                  "type": "keyword"
-                }
-              }
-            },
-            "to": {
-              "type": "keyword",
-              "normalizer": "username",
-              "fields": {
-                "raw": {
-                  "type": "keyword"
-                }
-              }
-            },
-            "message": {
-              "type": "text",
-              "analyzer": "english",
-              "fields": {
-                "shingles": {
-                  "type": "text",
-                  "analyzer": "shingles"
-                }
-              }
-            }
-          }
-        }
-      }
-    }
-    `
+	return idx.store().CreateIndex()
+}
 
-	req, err := http.NewRequest("PUT", idx.Client.Base+"/"+idx.Client.Index, strings.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	if err != nil {
-		return err
-	}
-	resp, err := idx.Client.Do(req)
-	if err != nil {
-		if err, ok := err.(es.APIError); ok {
-			if err.Err.Type == "resource_already_exists_exception" {
-				return nil
-			}
-		}
-		return err
-	}
-	defer resp.Body.Close()
-	return nil
+// Search returns up to count messages matching f.
+func (idx *Index) Search(f Filter, count int) ([]Message, error) {
+	return idx.store().Search(f, count)
 }
 
-func (idx *Index) Search(s es.Search, count int) ([]Message, error) {
-	hits, err := idx.Client.Search(s, count)
-	if err != nil {
-		return nil, err
-	}
-	out := make([]Message, len(hits))
-	for i, hit := range hits {
-		if err := json.Unmarshal(hit.Source, &out[i]); err != nil {
-			return nil, err
-		}
-	}
-	return out, nil
+// Context returns messages surrounding msg in its conversation.
+func (idx *Index) Context(msg Message, before, after int) ([]Message, error) {
+	return idx.store().Context(msg, before, after)
+}
+
+// Count returns the number of messages matching f.
+func (idx *Index) Count(f Filter) (int, error) {
+	return idx.store().Count(f)
+}
+
+// Delete deletes all messages matching f.
+func (idx *Index) Delete(f Filter) (DeleteResult, error) {
+	return idx.store().Delete(f)
 }
 
 type Weechat struct {
 	Client *es.Client
+	Config config.ChatIndex
 }
 
 func (w *Weechat) CreateIndex() error {
-	return (&Index{w.Client}).CreateIndex()
+	return (&Index{Client: w.Client, Config: w.Config}).CreateIndex()
 }
 
 var ircToRegexp = regexp.MustCompile(`^([^: ]+): `)
@@ -224,7 +155,7 @@ func (w *Weechat) Index(root string) (index.Statistics, error) {
 	if err != nil {
 		return index.Statistics{}, err
 	}
-	bi := w.Client.BulkInsert()
+	bi := (&Index{Client: w.Client, Config: w.Config}).store().NewWriter()
 	stats := index.Statistics{}
 	for _, channel := range channels {
 		idx := strings.Index(channel, "#")
@@ -303,6 +234,7 @@ func (w *Weechat) Index(root string) (index.Statistics, error) {
 					Message:      text,
 				}
 				if err := bi.Index(msg, ""); err != nil {
+					f.Close()
 					bi.Close()
 					return index.Statistics{}, err
 				}
@@ -311,7 +243,7 @@ func (w *Weechat) Index(root string) (index.Statistics, error) {
 			f.Close()
 		}
 	}
-	if err := bi.Close(); err != nil {
+	if _, _, err := bi.Close(); err != nil {
 		return index.Statistics{}, err
 	}
 	return stats, nil
@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"time"
 
+	"honnef.co/go/idxgrep/config"
 	"honnef.co/go/idxgrep/es"
 	"honnef.co/go/idxgrep/fs"
 	"honnef.co/go/idxgrep/index"
@@ -13,10 +14,11 @@ import (
 
 type Discord struct {
 	Client *es.Client
+	Config config.ChatIndex
 }
 
 func (w *Discord) CreateIndex() error {
-	return (&Index{w.Client}).CreateIndex()
+	return (&Index{Client: w.Client, Config: w.Config}).CreateIndex()
 }
 
 var discordUserMention = regexp.MustCompile(`<@(\d+)>`)
@@ -58,7 +60,7 @@ func (d *Discord) Index(path string) (index.Statistics, error) {
 		return index.Statistics{}, err
 	}
 
-	bi := d.Client.BulkInsert()
+	bi := (&Index{Client: d.Client, Config: d.Config}).store().NewWriter()
 	for chid, msgs := range log.Data {
 		ch := log.Meta.Channels[chid]
 		srv := log.Meta.Servers[ch.Server]
@@ -69,6 +71,7 @@ func (d *Discord) Index(path string) (index.Statistics, error) {
 		case "DM":
 			chName = ch.Name
 		default:
+			bi.Close()
 			return index.Statistics{}, fmt.Errorf("unknown server type %q", srv.Type)
 		}
 		conv := Conversation{
@@ -104,7 +107,7 @@ func (d *Discord) Index(path string) (index.Statistics, error) {
 			bi.Index(m, fmt.Sprintf("discord-%s-%s-%s", srv.Name, chid, mid))
 		}
 	}
-	if err := bi.Close(); err != nil {
+	if _, _, err := bi.Close(); err != nil {
 		return index.Statistics{}, err
 	}
 	return index.Statistics{Indexed: 1}, nil
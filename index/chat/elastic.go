@@ -0,0 +1,260 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+
+	"honnef.co/go/idxgrep/es"
+	"honnef.co/go/idxgrep/index"
+)
+
+// elasticStore stores messages in Elasticsearch.
+type elasticStore struct {
+	client *es.Client
+}
+
+// SchemaVersion is the version of the index's settings and mappings.
+// It has to be incremented whenever they change.
+const SchemaVersion = 1
+
+const settings = `
+    {
+      "number_of_shards": 1,
+      "number_of_replicas": 0,
+      "analysis": {
+        "filter": {
+          "shingles": {
+            "type": "shingle",
+            "min_shingle_size": 2,
+            "max_shingle_size": 2,
+            "output_unigrams": false
+          }
+        },
+        "char_filter": {
+          "username": {
+            "type": "pattern_replace",
+            "pattern": "^[+%@]?(.+)$",
+            "replacement": "$1"
+          }
+        },
+        "normalizer": {
+          "username": {
+            "type": "custom",
+            "char_filter": ["username"],
+            "filter": ["lowercase"]
+          }
+        },
+        "analyzer": {
+          "shingles": {
+            "type": "custom",
+            "tokenizer": "standard",
+            "filter": ["lowercase", "shingles"]
+          }
+        }
+      }
+    }
+    `
+
+const mappings = `
+    {
+      "properties": {
+        "protocol": {
+          "type": "keyword"
+        },
+        "server": {
+          "type": "keyword"
+        },
+        "channel_or_person": {
+          "type": "keyword"
+        },
+        "time": {
+          "type": "date",
+          "format": "epoch_millis"
+        },
+        "from": {
+          "type": "keyword",
+          "normalizer": "username",
+          "fields": {
+            "raw": {
+              "type": "keyword"
+            }
+          }
+        },
+        "to": {
+          "type": "keyword",
+          "normalizer": "username",
+          "fields": {
+            "raw": {
+              "type": "keyword"
+            }
+          }
+        },
+        "message": {
+          "type": "text",
+          "analyzer": "english",
+          "fields": {
+            "shingles": {
+              "type": "text",
+              "analyzer": "shingles"
+            }
+          }
+        }
+      }
+    }
+    `
+
+func (s *elasticStore) CreateIndex() error {
+	_, err := index.Create(s.client, settings, mappings, SchemaVersion)
+	return err
+}
+
+// CreateVersion creates the named index using the current schema,
+// for migrating to it.
+func (idx *Index) CreateVersion(name string) error {
+	return index.CreateVersion(idx.Client, name, settings, mappings, SchemaVersion)
+}
+
+func (s *elasticStore) NewWriter() Writer {
+	return elasticWriter{s.client.BulkInsert()}
+}
+
+type elasticWriter struct {
+	bi *es.BulkIndexer
+}
+
+func (w elasticWriter) Index(msg *Message, id string) error {
+	return w.bi.Index(msg, id)
+}
+
+func (w elasticWriter) Close() (indexed, failed int, err error) {
+	err = w.bi.Close()
+	return w.bi.Indexed, w.bi.Failed, err
+}
+
+func filterToES(f Filter) es.BoolQuery {
+	q := es.BoolQuery{}
+	terms := []struct {
+		key   string
+		value string
+	}{
+		{"protocol", f.Protocol},
+		{"server", f.Server},
+		{"channel_or_person", f.ChannelOrPerson},
+		{"from", f.From},
+	}
+	for _, t := range terms {
+		if t.value != "" {
+			q.Filter = append(q.Filter, es.Match{Key: t.key, Value: t.value})
+		}
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		r := es.Range{Key: "time"}
+		if !f.Since.IsZero() {
+			r.GTE = millis(f.Since)
+		}
+		if !f.Until.IsZero() {
+			r.LT = millis(f.Until)
+		}
+		q.Filter = append(q.Filter, r)
+	}
+	if f.Text != "" {
+		q.And = append(q.And, es.Match{Key: "message", Value: f.Text})
+		q.Or = append(q.Or, es.Match{Key: "message.shingles", Value: f.Text})
+	}
+	return q
+}
+
+func (s *elasticStore) search(search es.Search, count int) ([]Message, error) {
+	search.SeqNo = true
+	hits, err := s.client.Search(search, count)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Message, len(hits))
+	for i, hit := range hits {
+		if err := json.Unmarshal(hit.Source, &out[i]); err != nil {
+			return nil, err
+		}
+		out[i].pos = hit.SeqNo
+		out[i].hasPos = true
+	}
+	return out, nil
+}
+
+func (s *elasticStore) Search(f Filter, count int) ([]Message, error) {
+	return s.search(es.Search{Query: filterToES(f)}, count)
+}
+
+func (s *elasticStore) Context(msg Message, before, after int) ([]Message, error) {
+	f := Filter{
+		Protocol:        msg.Protocol,
+		Server:          msg.Server,
+		ChannelOrPerson: msg.ChannelOrPerson,
+	}
+	// Messages are ordered by time and then by sequence number, so
+	// that messages sent in the same millisecond keep their order and
+	// aren't lost. The index has a single shard, which makes sequence
+	// numbers unique.
+	lo, hi := msg.bounds()
+	var out []Message
+	if before > 0 {
+		msgs, err := s.search(es.Search{
+			Query:       filterToES(f),
+			Sort:        []es.Sort{{Key: "time", Desc: true}, {Key: "_seq_no", Desc: true}},
+			SearchAfter: []interface{}{millis(msg.Time), lo},
+		}, before)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(msgs) - 1; i >= 0; i-- {
+			out = append(out, msgs[i])
+		}
+	}
+	if after > 0 {
+		msgs, err := s.search(es.Search{
+			Query:       filterToES(f),
+			Sort:        []es.Sort{{Key: "time"}, {Key: "_seq_no"}},
+			SearchAfter: []interface{}{millis(msg.Time), hi},
+		}, after)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msgs...)
+	}
+	return out, nil
+}
+
+func (s *elasticStore) Count(f Filter) (int, error) {
+	return s.client.Count(filterToES(f))
+}
+
+func (s *elasticStore) Delete(f Filter) (DeleteResult, error) {
+	resp, err := s.client.DeleteByQuery(filterToES(f))
+	if err != nil {
+		return DeleteResult{}, err
+	}
+	for _, f := range resp.Failures {
+		log.Printf("Couldn't delete %s: %s: %s", f.ID, f.Cause.Type, f.Cause.Reason)
+	}
+	return DeleteResult{
+		Deleted:   resp.Deleted,
+		Failed:    len(resp.Failures),
+		Conflicts: resp.VersionConflicts,
+	}, nil
+}
+
+// Copy copies all messages to dst. Messages are stored in their
+// entirety, so Elasticsearch can reindex them by itself.
+func (idx *Index) Copy(dst *es.Client) (index.Statistics, error) {
+	resp, err := idx.Client.Reindex(dst.Index)
+	if err != nil {
+		return index.Statistics{}, err
+	}
+	for _, f := range resp.Failures {
+		log.Printf("Couldn't copy %s: %s: %s", f.ID, f.Cause.Type, f.Cause.Reason)
+	}
+	return index.Statistics{
+		Indexed: resp.Created + resp.Updated,
+		Failed:  len(resp.Failures),
+	}, nil
+}
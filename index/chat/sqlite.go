@@ -0,0 +1,344 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore stores messages in an SQLite database, using FTS5 for
+// full text search. The SQLite driver has to be built with the
+// sqlite_fts5 build tag.
+type sqliteStore struct {
+	path string
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY,
+	doc_id TEXT UNIQUE,
+	protocol TEXT NOT NULL,
+	server TEXT NOT NULL,
+	channel_or_person TEXT NOT NULL,
+	time INTEGER NOT NULL,
+	sender TEXT NOT NULL,
+	-- sender normalized the same way as in Elasticsearch
+	sender_norm TEXT NOT NULL,
+	recipients TEXT NOT NULL,
+	message TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_conversation ON messages (protocol, server, channel_or_person, time);
+CREATE INDEX IF NOT EXISTS messages_sender ON messages (sender_norm);
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5 (
+	message,
+	content='messages',
+	content_rowid='id',
+	tokenize='porter unicode61'
+);
+CREATE TRIGGER IF NOT EXISTS messages_ai AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts (rowid, message) VALUES (new.id, new.message);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_ad AFTER DELETE ON messages BEGIN
+	INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.id, old.message);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE ON messages BEGIN
+	INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.id, old.message);
+	INSERT INTO messages_fts (rowid, message) VALUES (new.id, new.message);
+END;
+`
+
+// sqliteBatchSize is the number of messages inserted per transaction.
+const sqliteBatchSize = 1000
+
+func (s *sqliteStore) open() (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", s.path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return nil, errors.New("SQLite was built without FTS5, rebuild idxgrep with -tags sqlite_fts5")
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *sqliteStore) CreateIndex() error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func (s *sqliteStore) NewWriter() Writer {
+	return &sqliteWriter{store: s}
+}
+
+type sqliteWriter struct {
+	store   *sqliteStore
+	db      *sql.DB
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	pending int
+	indexed int
+}
+
+// normalizeUser normalizes user names the same way as the username
+// normalizer of the Elasticsearch index.
+func normalizeUser(s string) string {
+	if len(s) > 1 && strings.ContainsRune("+%@", rune(s[0])) {
+		s = s[1:]
+	}
+	return strings.ToLower(s)
+}
+
+func (w *sqliteWriter) begin() error {
+	if w.db == nil {
+		db, err := w.store.open()
+		if err != nil {
+			return err
+		}
+		w.db = db
+	}
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+INSERT INTO messages (doc_id, protocol, server, channel_or_person, time, sender, sender_norm, recipients, message)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (doc_id) DO UPDATE SET
+	protocol = excluded.protocol,
+	server = excluded.server,
+	channel_or_person = excluded.channel_or_person,
+	time = excluded.time,
+	sender = excluded.sender,
+	sender_norm = excluded.sender_norm,
+	recipients = excluded.recipients,
+	message = excluded.message`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	w.tx = tx
+	w.stmt = stmt
+	return nil
+}
+
+func (w *sqliteWriter) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+	w.stmt.Close()
+	err := w.tx.Commit()
+	w.tx, w.stmt = nil, nil
+	w.indexed += w.pending
+	w.pending = 0
+	return err
+}
+
+func (w *sqliteWriter) Index(msg *Message, id string) error {
+	if w.tx == nil {
+		if err := w.begin(); err != nil {
+			return err
+		}
+	}
+	to, err := json.Marshal(msg.To)
+	if err != nil {
+		return err
+	}
+	var docID interface{}
+	if id != "" {
+		docID = id
+	}
+	_, err = w.stmt.Exec(docID, msg.Protocol, msg.Server, msg.ChannelOrPerson, millis(msg.Time),
+		msg.From, normalizeUser(msg.From), string(to), msg.Message)
+	if err != nil {
+		return err
+	}
+	w.pending++
+	if w.pending >= sqliteBatchSize {
+		return w.commit()
+	}
+	return nil
+}
+
+func (w *sqliteWriter) Close() (indexed, failed int, err error) {
+	err = w.commit()
+	if w.db != nil {
+		if cerr := w.db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return w.indexed, 0, err
+}
+
+// ftsQuery turns words into an FTS5 query that matches any of them.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, w := range words {
+		words[i] = `"` + strings.Replace(w, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(words, " OR ")
+}
+
+// where returns the WHERE clause and its arguments for f.
+func (f Filter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if f.Protocol != "" {
+		add("protocol = ?", f.Protocol)
+	}
+	if f.Server != "" {
+		add("server = ?", f.Server)
+	}
+	if f.ChannelOrPerson != "" {
+		add("channel_or_person = ?", f.ChannelOrPerson)
+	}
+	if f.From != "" {
+		add("sender_norm = ?", normalizeUser(f.From))
+	}
+	if !f.Since.IsZero() {
+		add("time >= ?", millis(f.Since))
+	}
+	if !f.Until.IsZero() {
+		add("time < ?", millis(f.Until))
+	}
+	if f.Text != "" {
+		add("id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)", ftsQuery(f.Text))
+	}
+	if len(conds) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+	var out []Message
+	for rows.Next() {
+		var (
+			m  Message
+			t  int64
+			to string
+		)
+		if err := rows.Scan(&m.Protocol, &m.Server, &m.ChannelOrPerson, &t, &m.From, &to, &m.Message, &m.pos); err != nil {
+			return nil, err
+		}
+		m.Time = time.Unix(0, t*int64(time.Millisecond))
+		m.hasPos = true
+		if err := json.Unmarshal([]byte(to), &m.To); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+const messageColumns = "protocol, server, channel_or_person, time, sender, recipients, message, id"
+
+func (s *sqliteStore) query(query string, args ...interface{}) ([]Message, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *sqliteStore) Search(f Filter, count int) ([]Message, error) {
+	if f.Text == "" {
+		where, args := f.where()
+		return s.query("SELECT "+messageColumns+" FROM messages WHERE "+where+" ORDER BY time DESC LIMIT ?",
+			append(args, count)...)
+	}
+	// Rank by relevance. The rank is only available when querying
+	// the FTS table directly.
+	g := f
+	g.Text = ""
+	where, args := g.where()
+	return s.query("SELECT "+messageColumns+" FROM messages JOIN "+
+		"(SELECT rowid, rank FROM messages_fts WHERE messages_fts MATCH ?) AS fts ON messages.id = fts.rowid "+
+		"WHERE "+where+" ORDER BY fts.rank LIMIT ?",
+		append(append([]interface{}{ftsQuery(f.Text)}, args...), count)...)
+}
+
+func (s *sqliteStore) Context(msg Message, before, after int) ([]Message, error) {
+	// Messages are ordered by time and then by ID, so that messages
+	// sent in the same millisecond keep their order and aren't lost.
+	const conv = "protocol = ? AND server = ? AND channel_or_person = ?"
+	t := millis(msg.Time)
+	lo, hi := msg.bounds()
+	var out []Message
+	if before > 0 {
+		msgs, err := s.query("SELECT "+messageColumns+" FROM messages WHERE "+conv+
+			" AND (time < ? OR time = ? AND id < ?) ORDER BY time DESC, id DESC LIMIT ?",
+			msg.Protocol, msg.Server, msg.ChannelOrPerson, t, t, lo, before)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(msgs) - 1; i >= 0; i-- {
+			out = append(out, msgs[i])
+		}
+	}
+	if after > 0 {
+		msgs, err := s.query("SELECT "+messageColumns+" FROM messages WHERE "+conv+
+			" AND (time > ? OR time = ? AND id > ?) ORDER BY time, id LIMIT ?",
+			msg.Protocol, msg.Server, msg.ChannelOrPerson, t, t, hi, after)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msgs...)
+	}
+	return out, nil
+}
+
+func (s *sqliteStore) Count(f Filter) (int, error) {
+	db, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	where, args := f.where()
+	var n int
+	err = db.QueryRow("SELECT count(*) FROM messages WHERE "+where, args...).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) Delete(f Filter) (DeleteResult, error) {
+	db, err := s.open()
+	if err != nil {
+		return DeleteResult{}, err
+	}
+	defer db.Close()
+	where, args := f.where()
+	res, err := db.Exec("DELETE FROM messages WHERE "+where, args...)
+	if err != nil {
+		return DeleteResult{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return DeleteResult{}, err
+	}
+	return DeleteResult{Deleted: int(n)}, nil
+}
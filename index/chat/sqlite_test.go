@@ -0,0 +1,154 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package chat
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func texts(msgs []Message) []string {
+	var out []string
+	for _, m := range msgs {
+		out = append(out, m.Message)
+	}
+	return out
+}
+
+func TestSQLiteStore(t *testing.T) {
+	s := &sqliteStore{path: filepath.Join(t.TempDir(), "chat.sqlite")}
+	if err := s.CreateIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	conv := Conversation{Protocol: "irc", Server: "freenode", ChannelOrPerson: "#go-nuts"}
+	other := Conversation{Protocol: "irc", Server: "freenode", ChannelOrPerson: "#idxgrep"}
+	msgs := []struct {
+		conv Conversation
+		from string
+		text string
+		id   string
+	}{
+		{conv, "@alice", "has anyone used trigram indices", ""},
+		{conv, "bob", "codesearch uses trigrams", ""},
+		{conv, "carol", "unrelated chatter", ""},
+		{other, "Alice", "indexing all the things", "x"},
+		{conv, "dave", "more chatter", ""},
+	}
+	w := s.NewWriter()
+	for i, m := range msgs {
+		msg := &Message{
+			Conversation: m.conv,
+			Time:         base.Add(time.Duration(i) * time.Minute),
+			From:         m.from,
+			To:           []string{},
+			Message:      m.text,
+		}
+		if err := w.Index(msg, m.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replaces the message with ID x
+	if err := w.Index(&Message{Conversation: other, Time: base, From: "alice", Message: "indexing everything"}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if indexed, _, err := w.Close(); err != nil || indexed != 6 {
+		t.Fatalf("Close() = %d, %v, want 6 messages", indexed, err)
+	}
+
+	tests := []struct {
+		f    Filter
+		want []string
+	}{
+		{Filter{Text: "trigrams"}, []string{"codesearch uses trigrams", "has anyone used trigram indices"}},
+		{Filter{Text: "chatter", ChannelOrPerson: "#go-nuts"}, []string{"more chatter", "unrelated chatter"}},
+		{Filter{From: "ALICE"}, []string{"has anyone used trigram indices", "indexing everything"}},
+		{Filter{Text: `"quoted" OR`}, nil},
+		{Filter{Since: base.Add(3 * time.Minute)}, []string{"more chatter"}},
+	}
+	for _, tt := range tests {
+		got, err := s.Search(tt.f, 10)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.f, err)
+			continue
+		}
+		// Ordering isn't what's being tested
+		g := texts(got)
+		sort.Strings(g)
+		if !reflect.DeepEqual(g, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.f, g, tt.want)
+		}
+	}
+
+	mid := Message{Conversation: conv, Time: base.Add(2 * time.Minute)}
+	ctx, err := s.Context(mid, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := texts(ctx), []string{"codesearch uses trigrams", "more chatter"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Context: got %q, want %q", got, want)
+	}
+
+	f := Filter{ChannelOrPerson: "#go-nuts"}
+	if n, err := s.Count(f); err != nil || n != 4 {
+		t.Errorf("Count() = %d, %v, want 4", n, err)
+	}
+	res, err := s.Delete(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Deleted != 4 {
+		t.Errorf("deleted %d messages, want 4", res.Deleted)
+	}
+	if got, err := s.Search(Filter{Text: "trigrams"}, 10); err != nil || len(got) != 0 {
+		t.Errorf("deleted messages are still found: %q, %v", texts(got), err)
+	}
+}
+
+func TestSQLiteContextSameTime(t *testing.T) {
+	s := &sqliteStore{path: filepath.Join(t.TempDir(), "chat.sqlite")}
+	if err := s.CreateIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	conv := Conversation{Protocol: "irc", Server: "freenode", ChannelOrPerson: "#go-nuts"}
+	w := s.NewWriter()
+	// Messages two to four are sent in the same second.
+	msgs := []struct {
+		sec  int
+		text string
+	}{{0, "one"}, {1, "two"}, {1, "three"}, {1, "four"}, {2, "five"}}
+	for _, m := range msgs {
+		msg := &Message{
+			Conversation: conv,
+			Time:         base.Add(time.Duration(m.sec) * time.Second),
+			From:         "alice",
+			To:           []string{},
+			Message:      m.text,
+		}
+		if err := w.Index(msg, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := s.Search(Filter{Text: "three"}, 1)
+	if err != nil || len(hits) != 1 {
+		t.Fatalf("Search() = %q, %v, want one message", texts(hits), err)
+	}
+	ctx, err := s.Context(hits[0], 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := texts(ctx), []string{"one", "two", "four", "five"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Context: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"path/filepath"
+	"time"
+
+	"honnef.co/go/idxgrep/config"
+)
+
+// Filter selects messages. Empty fields match all messages.
+type Filter struct {
+	Protocol        string
+	Server          string
+	ChannelOrPerson string
+	From            string
+	// Words to search for in the text of messages. Messages need to
+	// contain at least one of them, and are ranked by relevance.
+	Text  string
+	Since time.Time
+	Until time.Time
+}
+
+// Empty reports whether the filter matches all messages.
+func (f Filter) Empty() bool {
+	return f == Filter{}
+}
+
+// Store stores chat messages.
+type Store interface {
+	CreateIndex() error
+	// NewWriter returns a writer for adding messages. A writer must
+	// only be used by a single goroutine.
+	NewWriter() Writer
+	// Search returns up to count messages matching f.
+	Search(f Filter, count int) ([]Message, error)
+	// Context returns up to before messages preceding msg and up to
+	// after messages following it, in the same conversation and in
+	// chronological order. msg itself is not included. Messages with
+	// the same time as msg are only included if msg was returned by
+	// the store.
+	Context(msg Message, before, after int) ([]Message, error)
+	Count(f Filter) (int, error)
+	Delete(f Filter) (DeleteResult, error)
+}
+
+// DeleteResult is the outcome of deleting messages.
+type DeleteResult struct {
+	Deleted int
+	// Failed is the number of messages that couldn't be deleted.
+	Failed int
+	// Conflicts is the number of messages that changed while they
+	// were being deleted, and were thus left alone.
+	Conflicts int
+}
+
+// Writer adds messages to a store.
+type Writer interface {
+	// Index adds the message. If id isn't empty, the message replaces
+	// any existing message with the same ID.
+	Index(msg *Message, id string) error
+	// Close flushes pending messages and returns the number of
+	// messages that have been indexed and that have failed. Failures
+	// are logged.
+	Close() (indexed, failed int, err error)
+}
+
+func (idx *Index) store() Store {
+	if idx.Store != nil {
+		return idx.Store
+	}
+	switch idx.Config.Backend {
+	case config.BackendSQLite:
+		path := idx.Config.Path
+		if path == "" {
+			name := idx.Config.Index
+			if name == "" {
+				name = config.DefaultConfig.ChatIndex.Index
+			}
+			path = filepath.Join(config.DefaultDataDir, name+".sqlite")
+		}
+		return &sqliteStore{path: path}
+	default:
+		return &elasticStore{client: idx.Client}
+	}
+}
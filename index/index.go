@@ -3,6 +3,7 @@ package index
 type Statistics struct {
 	Indexed int
 	Skipped int
+	Failed  int
 }
 
 type Index interface {
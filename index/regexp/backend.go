@@ -0,0 +1,81 @@
+package regexp
+
+import (
+	"path/filepath"
+
+	"honnef.co/go/idxgrep/config"
+	"honnef.co/go/idxgrep/es"
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+// Backend stores indexed files and finds the files that may match a
+// query.
+type Backend interface {
+	CreateIndex() error
+	// NewWriter returns a writer for adding files. A writer must
+	// only be used by a single goroutine, but several writers may
+	// be used concurrently. Files are only guaranteed to be visible
+	// after all writers have been closed and Commit has returned.
+	NewWriter() Writer
+	Commit() error
+	Info() (Info, error)
+
+	// Search returns up to count files that may match q.
+	Search(q *parser.Query, opts SearchOptions, count int) ([]SearchHit, error)
+	// CountMatches returns the number of files that may match q,
+	// without a limit.
+	CountMatches(q *parser.Query, opts SearchOptions) (int, error)
+	// DocFreq returns the number of files containing each of the
+	// trigrams.
+	DocFreq(trigrams []string, lower bool) (DocFreq, error)
+	// Files calls fn for every file in, or below, root. Stored
+	// contents are only included if content is true.
+	Files(root string, content bool, fn func(SearchHit) error) error
+	// Count returns the number of files in, or below, root.
+	Count(root string) (int, error)
+	// Delete deletes all files in, or below, root.
+	Delete(root string) (*es.ByQueryResponse, error)
+	// DeleteIDs deletes the files with the given IDs. It returns the
+	// number of files that couldn't be deleted, and an error if the
+	// deletion as a whole failed.
+	DeleteIDs(ids ...string) (failed int, err error)
+}
+
+// Writer adds files to an index.
+type Writer interface {
+	// Index adds the document, replacing any existing document with
+	// the same ID.
+	Index(doc Document, id string) error
+	// Close flushes pending documents and returns the number of
+	// documents that have been indexed and that have failed.
+	// Failures are logged.
+	Close() (indexed, failed int, err error)
+}
+
+func (idx *Index) backend() Backend {
+	if idx.Backend != nil {
+		return idx.Backend
+	}
+	switch idx.Config.Backend {
+	case config.BackendLocal:
+		path := idx.Config.Path
+		if path == "" {
+			name := idx.Config.Index
+			if name == "" {
+				name = config.DefaultConfig.RegexpIndex.Index
+			}
+			path = filepath.Join(config.DefaultDataDir, name+".idx")
+		}
+		return &localBackend{path: path}
+	default:
+		return &elasticBackend{client: idx.Client, storeContent: idx.Config.StoreContent, grams: idx.grams()}
+	}
+}
+
+// grams returns the n-gram lengths configured for new indices.
+func (idx *Index) grams() parser.Grams {
+	if idx.Config.MinGram == 0 || idx.Config.MaxGram == 0 {
+		return parser.Trigrams
+	}
+	return parser.Grams{Min: idx.Config.MinGram, Max: idx.Config.MaxGram}
+}
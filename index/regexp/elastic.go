@@ -0,0 +1,450 @@
+package regexp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"honnef.co/go/idxgrep/es"
+	"honnef.co/go/idxgrep/index"
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+// elasticBackend stores the index in Elasticsearch.
+type elasticBackend struct {
+	client       *es.Client
+	storeContent bool
+	// n-gram lengths for new indices
+	grams parser.Grams
+}
+
+// pathTerm returns path the way it is stored in the analyzed path
+// field.
+func pathTerm(path string) string {
+	return strings.Replace(path, "\x00", "", -1)
+}
+
+// SchemaVersion is the version of the index's settings and mappings.
+// It has to be incremented whenever they change.
+const SchemaVersion = 2
+
+// lowerSchemaVersion is the first schema version with the data.lower
+// field.
+const lowerSchemaVersion = 2
+
+const settings = `
+	{
+	  "number_of_shards": 1,
+	  "number_of_replicas": 0,
+	  "analysis": {
+	    "tokenizer": {
+	      "trigram": {
+	        "type": "ngram",
+	        "min_gram": %d,
+	        "max_gram": %d
+	      },
+	      "path": {
+	        "type": "path_hierarchy",
+	        "delimiter": "/"
+	      }
+	    },
+	    "char_filter": {
+	      "nul_to_slash": {
+	        "type": "pattern_replace",
+	        "pattern": "\u0000",
+	        "replacement": ""
+	      }
+	    },
+	    "analyzer": {
+	      "trigram": {
+	        "type": "custom",
+	        "tokenizer": "trigram"
+	      },
+	      "trigram_lower": {
+	        "type": "custom",
+	        "tokenizer": "trigram",
+	        "filter": ["lowercase"]
+	      },
+	      "path": {
+	        "type": "custom",
+	        "tokenizer": "path",
+	        "char_filter": ["nul_to_slash"]
+	      }
+	    }
+	  }
+	}
+	`
+
+const mappings = `
+	{
+	  "_source": {
+	    "enabled": false
+	  },
+	  "properties": {
+	    "name": {
+	      "type": "keyword",
+	      "store": true
+	    },
+	    "path": {
+	      "type": "text",
+	      "analyzer": "path",
+	      "store": true
+	    },
+	    "data": {
+	      "type": "text",
+	      "analyzer": "trigram",
+	      "index_options": "docs",
+	      "fields": {
+	        "lower": {
+	          "type": "text",
+	          "analyzer": "trigram_lower",
+	          "index_options": "docs"
+	        }
+	      }
+	    },
+	    "content": {
+	      "type": "binary",
+	      "store": true
+	    }
+	  }
+	}
+	`
+
+// gramsKey is the key in the index's _meta field that stores the
+// lengths of the indexed n-grams. Indices without it contain
+// trigrams.
+const gramsKey = "idxgrep_grams"
+
+type gramsMeta struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// indexSettings returns the settings of an index of n-grams of the
+// lengths g.
+func indexSettings(g parser.Grams) string {
+	s := fmt.Sprintf(settings, g.Min, g.Max)
+	if d := g.Max - g.Min; d > 1 {
+		// Elasticsearch limits the difference to 1 by default.
+		s = strings.Replace(s, `"number_of_replicas": 0,`, fmt.Sprintf(`"number_of_replicas": 0, "max_ngram_diff": %d,`, d), 1)
+	}
+	return s
+}
+
+// indexMappings returns the mappings of an index of n-grams of the
+// lengths g.
+func indexMappings(g parser.Grams) (string, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(mappings), &m); err != nil {
+		return "", err
+	}
+	m["_meta"] = map[string]interface{}{gramsKey: gramsMeta{g.Min, g.Max}}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func (b *elasticBackend) CreateIndex() error {
+	m, err := indexMappings(b.grams)
+	if err != nil {
+		return err
+	}
+	created, err := index.Create(b.client, indexSettings(b.grams), m, SchemaVersion)
+	if err != nil || created {
+		return err
+	}
+	info, err := b.Info()
+	if err != nil {
+		return err
+	}
+	if info.Grams != b.grams {
+		log.Printf("Index %q contains %s, but the configuration asks for %s; run 'idxadmin migrate' to rebuild it",
+			b.client.Index, info.Grams, b.grams)
+	}
+	return b.addContentMapping()
+}
+
+func (b *elasticBackend) Info() (Info, error) {
+	meta, err := b.client.Meta()
+	if err != nil {
+		if err, ok := err.(es.APIError); ok && err.Err.Type == "index_not_found_exception" {
+			return Info{Grams: b.grams, LowerCase: true}, nil
+		}
+		return Info{}, err
+	}
+	version, err := index.SchemaOf(meta)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Grams: parser.Trigrams, LowerCase: version >= lowerSchemaVersion}
+	if raw, ok := meta[gramsKey]; ok {
+		var g gramsMeta
+		if err := json.Unmarshal(raw, &g); err != nil {
+			return Info{}, err
+		}
+		info.Grams = parser.Grams{Min: g.Min, Max: g.Max}
+	}
+	return info, nil
+}
+
+// CreateVersion creates the named index using the current schema,
+// for migrating to it.
+func (idx *Index) CreateVersion(name string) error {
+	g := idx.grams()
+	m, err := indexMappings(g)
+	if err != nil {
+		return err
+	}
+	return index.CreateVersion(idx.Client, name, indexSettings(g), m, SchemaVersion)
+}
+
+// addContentMapping adds the content field to indices that were
+// created before it existed.
+func (b *elasticBackend) addContentMapping() error {
+	if !b.storeContent {
+		return nil
+	}
+	return b.client.PutMapping(json.RawMessage(`{"properties": {"content": {"type": "binary", "store": true}}}`))
+}
+
+func (b *elasticBackend) NewWriter() Writer {
+	bi := b.client.BulkInsert()
+	bi.OnFailure = func(f es.BulkFailure) {
+		doc := f.Object.(Document)
+		log.Printf("Couldn't index %q: %s", filepath.Join(doc.Path, doc.Name), f)
+	}
+	return elasticWriter{bi}
+}
+
+type elasticWriter struct {
+	bi *es.BulkIndexer
+}
+
+func (w elasticWriter) Index(doc Document, id string) error {
+	return w.bi.Index(doc, id)
+}
+
+func (w elasticWriter) Close() (indexed, failed int, err error) {
+	err = w.bi.Close()
+	return w.bi.Indexed, w.bi.Failed, err
+}
+
+// Commit does nothing, documents are committed as they are flushed.
+func (b *elasticBackend) Commit() error {
+	return nil
+}
+
+func pathQuery(path string) interface{} {
+	if f := pathsToES([]string{path}); f != nil {
+		return f
+	}
+	return map[string]interface{}{"match_all": struct{}{}}
+}
+
+func (b *elasticBackend) Delete(path string) (*es.ByQueryResponse, error) {
+	return b.client.DeleteByQuery(pathQuery(path))
+}
+
+func (b *elasticBackend) Count(path string) (int, error) {
+	return b.client.Count(pathQuery(path))
+}
+
+func (b *elasticBackend) DeleteIDs(ids ...string) (int, error) {
+	bi := b.client.BulkInsert()
+	bi.OnFailure = func(f es.BulkFailure) {
+		log.Printf("Couldn't delete %s: %s", f.ID, f)
+	}
+	for _, id := range ids {
+		if err := bi.Delete(id); err != nil {
+			return bi.Failed, err
+		}
+	}
+	err := bi.Close()
+	return bi.Failed, err
+}
+
+// dataField returns the field that stores n-grams of the text, or of
+// the lower-cased text.
+func dataField(lower bool) string {
+	if lower {
+		return "data.lower"
+	}
+	return "data"
+}
+
+// queryToES returns the Elasticsearch query for q, searching the
+// n-grams stored in field.
+func queryToES(q *parser.Query, field string) interface{} {
+	out := es.BoolQuery{}
+	switch q.Op {
+	case parser.QAll:
+		return map[string]interface{}{"match_all": struct{}{}}
+	case parser.QNone:
+		return map[string]interface{}{"match_none": struct{}{}}
+	case parser.QAnd:
+		for _, tri := range q.Trigram {
+			out.And = append(out.And, es.Term{Key: field, Value: tri})
+		}
+		for _, sq := range q.Sub {
+			out.And = append(out.And, queryToES(sq, field))
+		}
+	case parser.QOr:
+		for _, tri := range q.Trigram {
+			out.Or = append(out.Or, es.Term{Key: field, Value: tri})
+		}
+		for _, sq := range q.Sub {
+			out.Or = append(out.Or, queryToES(sq, field))
+		}
+	}
+	if len(out.Or) > 0 {
+		out.MinimumOr = 1
+	}
+	return out
+}
+
+func pathsToES(paths []string) interface{} {
+	out := es.BoolQuery{MinimumOr: 1}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if path == "/" {
+			return nil
+		}
+		out.Or = append(out.Or,
+			es.Term{Key: "path", Value: pathTerm(path)},
+			es.BoolQuery{And: []interface{}{
+				es.Term{Key: "path", Value: pathTerm(filepath.Dir(path))},
+				es.Term{Key: "name", Value: filepath.Base(path)},
+			}},
+		)
+	}
+	return out
+}
+
+// searchQuery returns the Elasticsearch query for files matching q
+// and opts.
+func searchQuery(q *parser.Query, opts SearchOptions) es.BoolQuery {
+	query := es.BoolQuery{And: []interface{}{queryToES(q, dataField(opts.LowerCase))}}
+	if len(opts.Paths) > 0 {
+		if f := pathsToES(opts.Paths); f != nil {
+			query.Filter = append(query.Filter, f)
+		}
+	}
+	if opts.Name != "" {
+		// \ is an escape character in wildcard queries, but
+		// only * and ? are meant to be special.
+		query.Filter = append(query.Filter, es.Wildcard{Key: "name", Value: strings.Replace(opts.Name, `\`, `\\`, -1)})
+	}
+	return query
+}
+
+func (b *elasticBackend) search(q *parser.Query, opts SearchOptions) es.Search {
+	// Stored contents are fetched one file at a time by
+	// SearchHit.Open, as a page of large files might not fit in
+	// memory.
+	return es.Search{
+		Query:  searchQuery(q, opts),
+		Fields: []string{"name", "path"},
+	}
+}
+
+// content returns the stored content of the file with the given ID,
+// or nil if it has none.
+func (b *elasticBackend) content(id string) ([]byte, error) {
+	hit, found, err := b.client.Get(id, []string{"content"})
+	if err != nil || !found || hit.Fields == nil {
+		return nil, err
+	}
+	var f struct {
+		Content [][]byte `json:"content"`
+	}
+	if err := json.Unmarshal(hit.Fields, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Content) == 0 {
+		return nil, nil
+	}
+	return f.Content[0], nil
+}
+
+func (b *elasticBackend) CountMatches(q *parser.Query, opts SearchOptions) (int, error) {
+	return b.client.Count(searchQuery(q, opts))
+}
+
+func (b *elasticBackend) Search(q *parser.Query, opts SearchOptions, count int) ([]SearchHit, error) {
+	s := b.search(q, opts)
+	hits, err := b.client.Search(s, count)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]SearchHit, len(hits))
+	for i, hit := range hits {
+		out[i], err = decodeHit(hit)
+		if err != nil {
+			return nil, err
+		}
+		if b.storeContent {
+			id := hit.ID
+			out[i].content = func() ([]byte, error) { return b.content(id) }
+		}
+	}
+	return out, nil
+}
+
+func decodeHit(hit es.SearchHit) (SearchHit, error) {
+	var f struct {
+		Name    []string `json:"name"`
+		Path    []string `json:"path"`
+		Content [][]byte `json:"content"`
+	}
+	if err := json.Unmarshal(hit.Fields, &f); err != nil {
+		return SearchHit{}, err
+	}
+	out := SearchHit{
+		ID:   hit.ID,
+		Name: f.Name[0],
+		Path: f.Path[0],
+	}
+	if len(f.Content) > 0 {
+		out.Content = f.Content[0]
+	}
+	return out, nil
+}
+
+func (b *elasticBackend) DocFreq(trigrams []string, lower bool) (DocFreq, error) {
+	filters := make(map[string]interface{}, len(trigrams))
+	for _, tri := range trigrams {
+		filters[tri] = es.Term{Key: dataField(lower), Value: tri}
+	}
+	counts, total, err := b.client.FilterCounts(filters)
+	if err != nil {
+		return DocFreq{}, err
+	}
+	return DocFreq{Trigrams: counts, Total: total}, nil
+}
+
+// contentPageSize is the number of files per request when listing
+// files with their stored contents.
+const contentPageSize = 10
+
+func (b *elasticBackend) Files(root string, content bool, fn func(SearchHit) error) error {
+	s := es.Search{
+		Query:  pathQuery(root),
+		Fields: []string{"name", "path"},
+	}
+	size := 1000
+	if content {
+		s.Fields = append(s.Fields, "content")
+		// Files can be up to max_filesize each, so only request
+		// a few of them at a time.
+		size = contentPageSize
+	}
+	return b.client.Scroll(s, size, func(hit es.SearchHit) error {
+		h, err := decodeHit(hit)
+		if err != nil {
+			return err
+		}
+		return fn(h)
+	})
+}
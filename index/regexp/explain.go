@@ -0,0 +1,57 @@
+package regexp
+
+import (
+	"encoding/json"
+
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+// An Explanation describes how a search is executed.
+type Explanation struct {
+	// The query after simplification
+	Query *parser.Query
+	// The query sent to the backend
+	Plan *parser.Query
+	// Document frequencies of all trigrams in Query
+	DocFreq DocFreq
+	// The body of the search request sent to Elasticsearch, or nil
+	// for the local backend
+	Request json.RawMessage
+	// Upper bound of the number of candidate files, based on DocFreq
+	Estimate int
+	// Number of files matching Plan
+	Candidates int
+}
+
+// Explain describes how Search would execute the query q.
+func (idx *Index) Explain(q *parser.Query, opts SearchOptions) (*Explanation, error) {
+	b := idx.backend()
+	plan, df, err := idx.plan(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(df.Trigrams) == 0 {
+		// No trigrams were looked up, so the total is missing.
+		df.Total, err = b.Count("/")
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := &Explanation{
+		Query:    simplify(q),
+		Plan:     plan,
+		DocFreq:  df,
+		Estimate: estimate(plan, df),
+	}
+	if eb, ok := b.(*elasticBackend); ok {
+		out.Request, err = json.MarshalIndent(eb.search(plan, opts), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+	}
+	out.Candidates, err = b.CountMatches(plan, opts)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
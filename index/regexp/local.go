@@ -0,0 +1,320 @@
+package regexp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"honnef.co/go/idxgrep/es"
+	"honnef.co/go/idxgrep/internal/parser"
+	"honnef.co/go/idxgrep/internal/posting"
+)
+
+// localBackend stores the index in a single posting list file, for
+// use without Elasticsearch. Changes are merged into a new copy of
+// the file, so searches see either the old or the new state. Merges
+// hold a lock on a file next to the index, so that concurrent merges,
+// even by different processes, don't lose each other's changes.
+type localBackend struct {
+	path string
+
+	mu  sync.Mutex
+	seg posting.Segment
+	// Bytes of data in seg
+	pending int
+}
+
+var errLowerCase = errors.New("the local backend doesn't support queries for lower-cased text")
+
+// localMaxPending is the amount of data that is collected before it
+// gets merged into the index file.
+const localMaxPending = 64 * 1024 * 1024
+
+func (b *localBackend) CreateIndex() error {
+	if _, err := os.Stat(b.path); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	return b.merge(nil, nil)
+}
+
+// merge merges seg into the index file, dropping documents for which
+// drop returns true.
+func (b *localBackend) merge(seg *posting.Segment, drop func(posting.Doc) bool) error {
+	_, err := b.mergeCount(seg, drop)
+	return err
+}
+
+func (b *localBackend) mergeCount(seg *posting.Segment, drop func(posting.Doc) bool) (int, error) {
+	lock, err := lockFile(b.path + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	r, err := posting.Open(b.path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return posting.Merge(b.path, r, seg, drop)
+}
+
+func (b *localBackend) NewWriter() Writer {
+	return &localWriter{b: b}
+}
+
+type localWriter struct {
+	b       *localBackend
+	indexed int
+}
+
+func (w *localWriter) Index(doc Document, id string) error {
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	w.b.seg.Add(posting.Doc{
+		ID:      id,
+		Path:    doc.Path,
+		Name:    doc.Name,
+		Content: doc.Content,
+	}, []byte(doc.Data))
+	w.indexed++
+	w.b.pending += len(doc.Data)
+	if w.b.pending >= localMaxPending {
+		return w.b.commit()
+	}
+	return nil
+}
+
+func (w *localWriter) Close() (indexed, failed int, err error) {
+	return w.indexed, 0, nil
+}
+
+// Commit merges the documents of all writers into the index file.
+func (b *localBackend) Commit() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.commit()
+}
+
+func (b *localBackend) commit() error {
+	if b.seg.Len() == 0 {
+		return nil
+	}
+	if err := b.merge(&b.seg, nil); err != nil {
+		return err
+	}
+	b.seg = posting.Segment{}
+	b.pending = 0
+	return nil
+}
+
+// inRoot reports whether the file at p is root or is in, or below,
+// root.
+func inRoot(p, root string) bool {
+	root = filepath.Clean(root)
+	if root == "/" || p == root {
+		return true
+	}
+	if !strings.HasPrefix(p, root) {
+		return false
+	}
+	c := p[len(root)]
+	return c == '/' || c == '\x00'
+}
+
+// matchName reports whether name matches the glob pattern, in which
+// * matches any sequence of characters and ? matches a single
+// character. All other characters match themselves, as in
+// Elasticsearch's wildcard query.
+func matchName(pattern, name string) bool {
+	// Position after the last *, and the position in name it was
+	// tried at, for backtracking.
+	star, next := -1, 0
+	p, n := []rune(pattern), []rune(name)
+	i, j := 0, 0
+	for j < len(n) {
+		switch {
+		case i < len(p) && p[i] == '*':
+			star, next = i+1, j
+			i++
+		case i < len(p) && (p[i] == '?' || p[i] == n[j]):
+			i++
+			j++
+		case star >= 0:
+			next++
+			i, j = star, next
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+func docPath(doc posting.Doc) string {
+	return filepath.Join(doc.Path, doc.Name)
+}
+
+func docHit(doc posting.Doc, content bool) SearchHit {
+	hit := SearchHit{
+		ID:   doc.ID,
+		Name: doc.Name,
+		Path: doc.Path,
+	}
+	if content {
+		hit.Content = doc.Content
+	}
+	return hit
+}
+
+// matches calls fn for every document in r that matches q and opts,
+// until fn returns false.
+func matches(r *posting.Reader, q *parser.Query, opts SearchOptions, fn func(posting.Doc) bool) error {
+	if opts.LowerCase {
+		return errLowerCase
+	}
+	docs, err := r.PostingQuery(q)
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		doc, err := r.Doc(d)
+		if err != nil {
+			return err
+		}
+		if len(opts.Paths) > 0 {
+			p := docPath(doc)
+			found := false
+			for _, root := range opts.Paths {
+				if inRoot(p, root) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if opts.Name != "" && !matchName(opts.Name, doc.Name) {
+			continue
+		}
+		if !fn(doc) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) Search(q *parser.Query, opts SearchOptions, count int) ([]SearchHit, error) {
+	r, err := posting.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var out []SearchHit
+	if count == 0 {
+		return out, nil
+	}
+	err = matches(r, q, opts, func(doc posting.Doc) bool {
+		out = append(out, docHit(doc, true))
+		return len(out) != count
+	})
+	return out, err
+}
+
+func (b *localBackend) CountMatches(q *parser.Query, opts SearchOptions) (int, error) {
+	r, err := posting.Open(b.path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n := 0
+	err = matches(r, q, opts, func(posting.Doc) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+// Info reports trigrams, the only n-grams supported by the posting
+// list format, which doesn't store lower-cased text either.
+func (b *localBackend) Info() (Info, error) {
+	return Info{Grams: parser.Trigrams}, nil
+}
+
+func (b *localBackend) DocFreq(trigrams []string, lower bool) (DocFreq, error) {
+	if lower {
+		return DocFreq{}, errLowerCase
+	}
+	r, err := posting.Open(b.path)
+	if err != nil {
+		return DocFreq{}, err
+	}
+	defer r.Close()
+	df := DocFreq{Trigrams: make(map[string]int, len(trigrams)), Total: r.NumDocs()}
+	for _, tri := range trigrams {
+		n, err := r.DocFreq(posting.Trigram(tri))
+		if err != nil {
+			return DocFreq{}, err
+		}
+		df.Trigrams[tri] = n
+	}
+	return df, nil
+}
+
+func (b *localBackend) Files(root string, content bool, fn func(SearchHit) error) error {
+	r, err := posting.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for i := 0; i < r.NumDocs(); i++ {
+		doc, err := r.Doc(uint32(i))
+		if err != nil {
+			return err
+		}
+		if !inRoot(docPath(doc), root) {
+			continue
+		}
+		if err := fn(docHit(doc, content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *localBackend) Count(root string) (int, error) {
+	n := 0
+	err := b.Files(root, false, func(SearchHit) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func (b *localBackend) Delete(root string) (*es.ByQueryResponse, error) {
+	n, err := b.mergeCount(nil, func(doc posting.Doc) bool {
+		return inRoot(docPath(doc), root)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &es.ByQueryResponse{Total: n, Deleted: n}, nil
+}
+
+func (b *localBackend) DeleteIDs(ids ...string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	m := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		m[id] = true
+	}
+	err := b.merge(nil, func(doc posting.Doc) bool {
+		return m[doc.ID]
+	})
+	return 0, err
+}
@@ -0,0 +1,249 @@
+package regexp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"sort"
+	"sync"
+	"testing"
+
+	"honnef.co/go/idxgrep/config"
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+var localFiles = map[string]string{
+	"/src/foo/a.go":    "package foo // hello world",
+	"/src/foo/b.txt":   "hello there",
+	"/src/foobar/c.go": "package foobar // hello world",
+	"/src/bar/d.go":    "package bar",
+}
+
+// newLocalIndex returns an index using the local backend that
+// contains files.
+func newLocalIndex(t *testing.T, files map[string]string) *Index {
+	t.Helper()
+	idx := &Index{Config: config.RegexpIndex{
+		Backend: config.BackendLocal,
+		Path:    filepath.Join(t.TempDir(), "test.idx"),
+	}}
+	if err := idx.CreateIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexFiles(idx.backend(), idx, files); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+// indexFiles adds files, which map paths to contents, to b.
+func indexFiles(b Backend, idx *Index, files map[string]string) error {
+	w := b.NewWriter()
+	for path, data := range files {
+		doc, err := idx.document(path, []byte(data))
+		if err != nil {
+			return err
+		}
+		if err := w.Index(doc, ID(path)); err != nil {
+			return err
+		}
+	}
+	if _, _, err := w.Close(); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// search returns the sorted paths of the files that may match expr.
+func search(t *testing.T, idx *Index, expr string, opts SearchOptions) []string {
+	t.Helper()
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := idx.Search(parser.RegexpQuery(re), opts, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, hit := range hits {
+		out = append(out, filepath.Join(hit.Path, hit.Name))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// files returns the sorted paths of all files in the index.
+func files(t *testing.T, idx *Index, root string) []string {
+	t.Helper()
+	var out []string
+	err := idx.Files(root, func(hit SearchHit) error {
+		out = append(out, filepath.Join(hit.Path, hit.Name))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestLocalSearch(t *testing.T) {
+	idx := newLocalIndex(t, localFiles)
+	tests := []struct {
+		expr string
+		opts SearchOptions
+		want []string
+	}{
+		{"hello", SearchOptions{}, []string{"/src/foo/a.go", "/src/foo/b.txt", "/src/foobar/c.go"}},
+		{"hello world", SearchOptions{}, []string{"/src/foo/a.go", "/src/foobar/c.go"}},
+		{"package", SearchOptions{Paths: []string{"/src/foo"}}, []string{"/src/foo/a.go"}},
+		{"package", SearchOptions{Paths: []string{"/src/foo/", "/src/bar"}}, []string{"/src/bar/d.go", "/src/foo/a.go"}},
+		{"hello", SearchOptions{Name: "*.go"}, []string{"/src/foo/a.go", "/src/foobar/c.go"}},
+		{"hello", SearchOptions{Name: "?.txt"}, []string{"/src/foo/b.txt"}},
+		{"xyzzy", SearchOptions{}, nil},
+	}
+	for _, tt := range tests {
+		if got := search(t, idx, tt.expr, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q, %+v) = %q, want %q", tt.expr, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	idx := newLocalIndex(t, localFiles)
+	if n, err := idx.Count("/src/foo"); err != nil || n != 2 {
+		t.Errorf("Count(/src/foo) = %d, %v, want 2", n, err)
+	}
+	resp, err := idx.Delete("/src/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != 2 {
+		t.Errorf("Delete(/src/foo) deleted %d files, want 2", resp.Deleted)
+	}
+	want := []string{"/src/bar/d.go", "/src/foobar/c.go"}
+	if got := files(t, idx, "/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("after Delete, files = %q, want %q", got, want)
+	}
+
+	if failed, err := idx.DeleteIDs(ID("/src/bar/d.go"), ID("/src/missing")); err != nil || failed != 0 {
+		t.Fatalf("DeleteIDs() = %d, %v, want no failures", failed, err)
+	}
+	want = []string{"/src/foobar/c.go"}
+	if got := files(t, idx, "/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("after DeleteIDs, files = %q, want %q", got, want)
+	}
+	if got := search(t, idx, "package", SearchOptions{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("after DeleteIDs, Search = %q, want %q", got, want)
+	}
+}
+
+func TestLocalConcurrentMerge(t *testing.T) {
+	// Backends sharing a file, as in different processes, don't
+	// lose each other's changes.
+	idx := newLocalIndex(t, nil)
+	var wg sync.WaitGroup
+	want := make([]string, 0, 8)
+	for i := 0; i < 8; i++ {
+		path := filepath.Join("/src", string(rune('a'+i)))
+		want = append(want, path)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := &localBackend{path: idx.Config.Path}
+			if err := indexFiles(b, idx, map[string]string{path: "some text"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := files(t, idx, "/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %q, want %q", got, want)
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.go", "a.go", true},
+		{"*.go", "a.go.txt", false},
+		{"?.go", "ab.go", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"*", "", true},
+		{"", "a", false},
+		{"ä?", "äö", true},
+		{"[ab].go", "a.go", false},
+		{"[ab].go", "[ab].go", true},
+		{`a\*`, `a\bc`, true},
+		{`a\*`, "a*", false},
+	}
+	for _, tt := range tests {
+		if got := matchName(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchName(%q, %q) = %t, want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir := t.TempDir()
+	onDisk := map[string]string{
+		"foo/a":    "alpha",
+		"foobar/b": "beta",
+	}
+	indexed := map[string]string{
+		filepath.Join(dir, "foo/gone"): "gone",
+	}
+	for name, data := range onDisk {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		indexed[path] = data
+	}
+	idx := newLocalIndex(t, indexed)
+
+	from, to := filepath.Join(dir, "foo"), filepath.Join(dir, "baz")
+	want := []string{from + "/a", from + "/gone"}
+	if got := files(t, idx, from); !reflect.DeepEqual(got, want) {
+		t.Errorf("Files(%s) = %q, want %q", from, got, want)
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := idx.Move(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Indexed != 1 || stats.Skipped != 1 {
+		t.Errorf("Move: indexed %d, skipped %d, want 1 and 1", stats.Indexed, stats.Skipped)
+	}
+	// The file that couldn't be read keeps its old entry, the
+	// sibling sharing a prefix isn't touched.
+	want = []string{to + "/a", from + "/gone", dir + "/foobar/b"}
+	sort.Strings(want)
+	if got := files(t, idx, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("after Move, files = %q, want %q", got, want)
+	}
+	if got := search(t, idx, "alpha", SearchOptions{}); !reflect.DeepEqual(got, []string{to + "/a"}) {
+		t.Errorf("after Move, Search = %q, want [%s/a]", got, to)
+	}
+
+	if err := idx.DeleteFile(from + "/gone"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{to + "/a", dir + "/foobar/b"}
+	sort.Strings(want)
+	if got := files(t, idx, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("after DeleteFile, files = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+// +build !unix
+
+package regexp
+
+import "os"
+
+// lockFile opens the file at path, creating it if necessary. Other
+// processes aren't locked out on this platform.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+}
@@ -0,0 +1,253 @@
+package regexp
+
+import (
+	"sort"
+
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+// defaultMaxQueryTrigrams is the number of trigrams kept in each AND
+// of a query when the configuration doesn't specify a limit.
+const defaultMaxQueryTrigrams = 16
+
+// DocFreq holds document frequencies of trigrams.
+type DocFreq struct {
+	// Number of documents containing each trigram
+	Trigrams map[string]int
+	// Number of documents in the index
+	Total int
+}
+
+// Plan returns the query that Search sends to the backend for q. It
+// simplifies q and, using document frequencies from the index, drops
+// the most common trigrams from conjunctions. The result matches at
+// least the documents that q matches.
+func (idx *Index) Plan(q *parser.Query, opts SearchOptions) (*parser.Query, error) {
+	q, _, err := idx.plan(q, opts)
+	return q, err
+}
+
+// plan is like Plan but also returns the document frequencies of all
+// trigrams in the simplified query.
+func (idx *Index) plan(q *parser.Query, opts SearchOptions) (*parser.Query, DocFreq, error) {
+	q = simplify(q)
+	df, err := idx.DocFreq(trigrams(q), opts.LowerCase)
+	if err != nil {
+		return nil, DocFreq{}, err
+	}
+	max := idx.Config.MaxQueryTrigrams
+	if max == 0 {
+		max = defaultMaxQueryTrigrams
+	}
+	return limit(q, df, max), df, nil
+}
+
+// DocFreq returns the document frequencies of the trigrams, in
+// lower-cased text if lower is set.
+func (idx *Index) DocFreq(trigrams []string, lower bool) (DocFreq, error) {
+	if len(trigrams) == 0 {
+		return DocFreq{Trigrams: map[string]int{}}, nil
+	}
+	return idx.backend().DocFreq(trigrams, lower)
+}
+
+// trigrams returns the sorted, unique trigrams in q.
+func trigrams(q *parser.Query) []string {
+	seen := map[string]bool{}
+	var walk func(q *parser.Query)
+	walk = func(q *parser.Query) {
+		for _, t := range q.Trigram {
+			seen[t] = true
+		}
+		for _, sq := range q.Sub {
+			walk(sq)
+		}
+	}
+	walk(q)
+	out := make([]string, 0, len(seen))
+	for t := range seen {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// simplify flattens nested conjunctions and disjunctions and removes
+// trigrams that are implied by other parts of the query. It returns
+// a new query that is equivalent to q.
+func simplify(q *parser.Query) *parser.Query {
+	return flatten(dedupe(flatten(q), nil))
+}
+
+// flatten merges sub-queries into their parent if they use the same
+// operator, or consist of a single trigram, and removes duplicate
+// trigrams.
+func flatten(q *parser.Query) *parser.Query {
+	if q.Op != parser.QAnd && q.Op != parser.QOr {
+		return q
+	}
+	out := &parser.Query{Op: q.Op}
+	out.Trigram = append(out.Trigram, q.Trigram...)
+	for _, sq := range q.Sub {
+		sq = flatten(sq)
+		switch {
+		case sq.Op == parser.QAll && q.Op == parser.QAnd,
+			sq.Op == parser.QNone && q.Op == parser.QOr:
+			// Neutral element
+			continue
+		case sq.Op == parser.QAll, sq.Op == parser.QNone:
+			// Absorbing element
+			return sq
+		case sq.Op == q.Op, len(sq.Sub) == 0 && len(sq.Trigram) == 1:
+			out.Trigram = append(out.Trigram, sq.Trigram...)
+			out.Sub = append(out.Sub, sq.Sub...)
+		default:
+			out.Sub = append(out.Sub, sq)
+		}
+	}
+	out.Trigram = uniq(out.Trigram)
+	switch {
+	case len(out.Trigram) == 0 && len(out.Sub) == 0:
+		if q.Op == parser.QAnd {
+			return &parser.Query{Op: parser.QAll}
+		}
+		return &parser.Query{Op: parser.QNone}
+	case len(out.Trigram) == 0 && len(out.Sub) == 1:
+		return out.Sub[0]
+	}
+	return out
+}
+
+// dedupe removes trigrams that are already required by an enclosing
+// conjunction. Because queries are monotonic, such trigrams can be
+// treated as always present anywhere below that conjunction.
+func dedupe(q *parser.Query, required map[string]bool) *parser.Query {
+	switch q.Op {
+	case parser.QAnd:
+		out := &parser.Query{Op: parser.QAnd}
+		inner := make(map[string]bool, len(required)+len(q.Trigram))
+		for t := range required {
+			inner[t] = true
+		}
+		for _, t := range q.Trigram {
+			if !required[t] {
+				out.Trigram = append(out.Trigram, t)
+			}
+			inner[t] = true
+		}
+		for _, sq := range q.Sub {
+			out.Sub = append(out.Sub, dedupe(sq, inner))
+		}
+		return out
+	case parser.QOr:
+		out := &parser.Query{Op: parser.QOr}
+		alts := map[string]bool{}
+		for _, t := range q.Trigram {
+			if required[t] {
+				// One alternative is always present.
+				return &parser.Query{Op: parser.QAll}
+			}
+			out.Trigram = append(out.Trigram, t)
+			alts[t] = true
+		}
+	subs:
+		for _, sq := range q.Sub {
+			if sq.Op == parser.QAnd {
+				// t OR (t AND x) is t.
+				for _, t := range sq.Trigram {
+					if alts[t] {
+						continue subs
+					}
+				}
+			}
+			out.Sub = append(out.Sub, dedupe(sq, required))
+		}
+		return out
+	default:
+		return q
+	}
+}
+
+// limit keeps at most max trigrams in each conjunction of q, the
+// rarest ones first, and drops trigrams that occur in every document.
+// Trigrams in disjunctions are never dropped, as that would make the
+// query more restrictive. A negative max keeps all trigrams.
+func limit(q *parser.Query, df DocFreq, max int) *parser.Query {
+	if q.Op != parser.QAnd && q.Op != parser.QOr {
+		return q
+	}
+	out := &parser.Query{Op: q.Op}
+	for _, sq := range q.Sub {
+		out.Sub = append(out.Sub, limit(sq, df, max))
+	}
+	if q.Op == parser.QOr {
+		out.Trigram = q.Trigram
+		return flatten(out)
+	}
+	for _, t := range q.Trigram {
+		if df.Total > 0 && df.Trigrams[t] >= df.Total {
+			continue
+		}
+		out.Trigram = append(out.Trigram, t)
+	}
+	sort.SliceStable(out.Trigram, func(i, j int) bool {
+		return df.Trigrams[out.Trigram[i]] < df.Trigrams[out.Trigram[j]]
+	})
+	if max >= 0 && len(out.Trigram) > max {
+		out.Trigram = out.Trigram[:max]
+	}
+	return flatten(out)
+}
+
+// estimate returns an upper bound of the number of documents that
+// match q, based on the document frequencies of its trigrams.
+func estimate(q *parser.Query, df DocFreq) int {
+	switch q.Op {
+	case parser.QAll:
+		return df.Total
+	case parser.QNone:
+		return 0
+	case parser.QAnd:
+		n := df.Total
+		for _, t := range q.Trigram {
+			if df.Trigrams[t] < n {
+				n = df.Trigrams[t]
+			}
+		}
+		for _, sq := range q.Sub {
+			if m := estimate(sq, df); m < n {
+				n = m
+			}
+		}
+		return n
+	default:
+		n := 0
+		for _, t := range q.Trigram {
+			n += df.Trigrams[t]
+		}
+		for _, sq := range q.Sub {
+			n += estimate(sq, df)
+		}
+		if n > df.Total {
+			n = df.Total
+		}
+		return n
+	}
+}
+
+// uniq removes duplicates from s, keeping the order of first
+// occurrences.
+func uniq(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(s))
+	out := s[:0:0]
+	for _, x := range s {
+		if !seen[x] {
+			seen[x] = true
+			out = append(out, x)
+		}
+	}
+	return out
+}
@@ -0,0 +1,199 @@
+package regexp
+
+import (
+	"regexp/syntax"
+	"testing"
+
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+func tri(ts ...string) *parser.Query {
+	return &parser.Query{Op: parser.QAnd, Trigram: ts}
+}
+
+func TestSimplify(t *testing.T) {
+	tests := []struct {
+		q    *parser.Query
+		want string
+	}{
+		// Nested conjunctions are merged and deduplicated.
+		{
+			&parser.Query{Op: parser.QAnd, Trigram: []string{"abc"}, Sub: []*parser.Query{
+				tri("abc", "bcd"),
+				{Op: parser.QAnd, Sub: []*parser.Query{tri("cde")}},
+			}},
+			`"abc" "bcd" "cde"`,
+		},
+		// A required trigram satisfies a disjunction.
+		{
+			&parser.Query{Op: parser.QAnd, Trigram: []string{"abc"}, Sub: []*parser.Query{
+				{Op: parser.QOr, Trigram: []string{"abc", "xyz"}},
+			}},
+			`"abc"`,
+		},
+		// A required trigram is removed below a disjunction.
+		{
+			&parser.Query{Op: parser.QAnd, Trigram: []string{"abc"}, Sub: []*parser.Query{
+				{Op: parser.QOr, Sub: []*parser.Query{tri("abc", "bcd"), tri("xyz", "yzw")}},
+			}},
+			`"abc" ("bcd")|("xyz" "yzw")`,
+		},
+		// t OR (t AND x) is t.
+		{
+			&parser.Query{Op: parser.QOr, Trigram: []string{"abc"}, Sub: []*parser.Query{
+				tri("abc", "bcd"),
+				{Op: parser.QOr, Trigram: []string{"xyz"}},
+			}},
+			`("abc"|"xyz")`,
+		},
+		{&parser.Query{Op: parser.QAnd, Sub: []*parser.Query{tri("abc"), {Op: parser.QNone}}}, `-`},
+		{&parser.Query{Op: parser.QOr, Sub: []*parser.Query{tri("abc"), {Op: parser.QAll}}}, `+`},
+	}
+	for _, tt := range tests {
+		if got := simplify(tt.q).String(); got != tt.want {
+			t.Errorf("simplify(%s) = %s, want %s", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	df := DocFreq{
+		Trigrams: map[string]int{"abc": 50, "bcd": 3, "cde": 10, "def": 100, "xyz": 90},
+		Total:    100,
+	}
+	tests := []struct {
+		q    *parser.Query
+		max  int
+		want string
+	}{
+		// Rare trigrams are kept first, ubiquitous ones are dropped.
+		{tri("abc", "bcd", "cde", "def"), 2, `"bcd" "cde"`},
+		{tri("abc", "bcd", "cde", "def"), -1, `"bcd" "cde" "abc"`},
+		{tri("def"), -1, `+`},
+		// Disjunctions keep all their trigrams.
+		{&parser.Query{Op: parser.QOr, Trigram: []string{"abc", "bcd", "cde", "def"}}, 1, `("abc"|"bcd"|"cde"|"def")`},
+		{
+			&parser.Query{Op: parser.QOr, Sub: []*parser.Query{tri("abc", "bcd", "cde"), tri("def", "xyz")}},
+			1,
+			`("bcd"|"xyz")`,
+		},
+	}
+	for _, tt := range tests {
+		if got := limit(tt.q, df, tt.max).String(); got != tt.want {
+			t.Errorf("limit(%s, %d) = %s, want %s", tt.q, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	df := DocFreq{
+		Trigrams: map[string]int{"abc": 50, "bcd": 3, "cde": 10, "xyz": 90},
+		Total:    100,
+	}
+	or := func(sub ...*parser.Query) *parser.Query {
+		return &parser.Query{Op: parser.QOr, Sub: sub}
+	}
+	tests := []struct {
+		q    *parser.Query
+		want int
+	}{
+		{&parser.Query{Op: parser.QAll}, 100},
+		{&parser.Query{Op: parser.QNone}, 0},
+		// Conjunctions match at most as many documents as their
+		// rarest part.
+		{tri("abc", "bcd", "cde"), 3},
+		{&parser.Query{Op: parser.QAnd, Trigram: []string{"abc"}, Sub: []*parser.Query{or(tri("cde"), tri("bcd"))}}, 13},
+		{&parser.Query{Op: parser.QAnd, Sub: []*parser.Query{{Op: parser.QNone}, tri("abc")}}, 0},
+		// Disjunctions match at most the sum of their parts, but
+		// never more than all documents.
+		{&parser.Query{Op: parser.QOr, Trigram: []string{"bcd", "cde"}}, 13},
+		{&parser.Query{Op: parser.QOr, Trigram: []string{"abc", "xyz"}}, 100},
+		{or(tri("bcd"), &parser.Query{Op: parser.QAll}), 100},
+		{or(tri("bcd"), &parser.Query{Op: parser.QNone}), 3},
+		// Unknown trigrams occur in no documents.
+		{&parser.Query{Op: parser.QOr, Trigram: []string{"zzz"}}, 0},
+	}
+	for _, tt := range tests {
+		if got := estimate(tt.q, df); got != tt.want {
+			t.Errorf("estimate(%s) = %d, want %d", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestExplainWithoutTrigrams(t *testing.T) {
+	idx := newLocalIndex(t, localFiles)
+	re, err := syntax.Parse("ab", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The query has no trigrams to look up, so the total comes from
+	// counting all files.
+	e, err := idx.Explain(parser.RegexpQuery(re), SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(localFiles)
+	if e.DocFreq.Total != n || e.Estimate != n || e.Candidates != n {
+		t.Errorf("Explain() = total %d, estimate %d, %d candidates, want %d each",
+			e.DocFreq.Total, e.Estimate, e.Candidates, n)
+	}
+}
+
+func TestSimplifyRegexp(t *testing.T) {
+	// Simplifying must not change which trigram sets a query accepts.
+	for _, expr := range []string{"hello world", "(foo|bar)baz", "abc(abcd|abce)", "func (\\w+) error"} {
+		re, err := syntax.Parse(expr, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := parser.RegexpQuery(re.Simplify())
+		s := simplify(q)
+		for _, text := range []string{"hello world", "foobaz", "barbaz", "abcabcd", "abce", "func x() error"} {
+			if got, want := eval(s, text), eval(q, text); got != want {
+				t.Errorf("%s on %q: simplified query %s = %t, original %s = %t", expr, text, s, got, q, want)
+			}
+		}
+	}
+}
+
+// eval reports whether q matches text.
+func eval(q *parser.Query, text string) bool {
+	has := func(t string) bool {
+		for i := 0; i+len(t) <= len(text); i++ {
+			if text[i:i+len(t)] == t {
+				return true
+			}
+		}
+		return false
+	}
+	switch q.Op {
+	case parser.QAll:
+		return true
+	case parser.QNone:
+		return false
+	case parser.QAnd:
+		for _, t := range q.Trigram {
+			if !has(t) {
+				return false
+			}
+		}
+		for _, sq := range q.Sub {
+			if !eval(sq, text) {
+				return false
+			}
+		}
+		return true
+	default:
+		for _, t := range q.Trigram {
+			if has(t) {
+				return true
+			}
+		}
+		for _, sq := range q.Sub {
+			if eval(sq, text) {
+				return true
+			}
+		}
+		return false
+	}
+}
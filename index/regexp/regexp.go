@@ -1,12 +1,14 @@
 package regexp
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,124 +28,222 @@ type Document struct {
 	Data string `json:"data"`
 	Name string `json:"name"`
 	Path string `json:"path"`
+	// Gzip compressed copy of Data, if contents are being stored.
+	Content []byte `json:"content,omitempty"`
 }
 
 type Index struct {
 	Config config.RegexpIndex
 	Client *es.Client
+	// Backend stores the index. If nil, it is chosen according to
+	// Config.
+	Backend Backend
 }
 
+// ID returns the ID of the document for the file at path.
+func ID(path string) string {
+	id := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(id[:])
+}
+
+func (idx *Index) document(path string, data []byte) (Document, error) {
+	doc := Document{
+		Data: string(data),
+		Name: filepath.Base(path),
+		Path: filepath.Dir(path),
+	}
+	if idx.Config.StoreContent {
+		var err error
+		doc.Content, err = compress(data)
+		if err != nil {
+			return Document{}, err
+		}
+	}
+	return doc, nil
+}
+
+// Delete deletes the file at path, or all files in and below the
+// directory at path, from the index.
 func (idx *Index) Delete(path string) (*es.ByQueryResponse, error) {
-	path = strings.Replace(path, "\x00", "", -1)
-	q := map[string]interface{}{
-		"term": map[string]interface{}{
-			"path": path,
-		},
+	return idx.backend().Delete(path)
+}
+
+// Count returns the number of files that Delete would delete.
+func (idx *Index) Count(path string) (int, error) {
+	return idx.backend().Count(path)
+}
+
+// DeleteID deletes the single file with the given ID from the index.
+func (idx *Index) DeleteID(id string) error {
+	failed, err := idx.backend().DeleteIDs(id)
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("couldn't delete %s", id)
 	}
+	return err
+}
 
-	return idx.Client.DeleteByQuery(q)
+// DeleteIDs deletes the files with the given IDs from the index, in
+// as few requests as possible. It is much cheaper than deleting them
+// one by one. It returns the number of files that couldn't be
+// deleted, and an error if the deletion as a whole failed.
+func (idx *Index) DeleteIDs(ids ...string) (failed int, err error) {
+	return idx.backend().DeleteIDs(ids...)
 }
 
-func (idx *Index) CreateIndex() error {
-	body := `
-	{
-	  "settings": {
-	    "number_of_shards": 1,
-	    "number_of_replicas": 0,
-	    "analysis": {
-          "tokenizer": {
-            "trigram": {
-              "type": "ngram",
-              "min_gram": 3,
-              "max_gram": 3
-            },
-            "path": {
-              "type": "path_hierarchy",
-              "delimiter": "/"
-            }
-          },
-          "char_filter": {
-            "nul_to_slash": {
-              "type": "pattern_replace",
-              "pattern": "\u0000",
-              "replacement": ""
-            }
-          },
-	      "analyzer": {
-	        "trigram": {
-	          "type": "custom",
-	          "tokenizer": "trigram"
-	        },
-            "path": {
-              "type": "custom",
-              "tokenizer": "path",
-              "char_filter": ["nul_to_slash"]
-            }
-	      }
-	    }
-	  },
-	  "mappings": {
-	    "_doc": {
-	      "_source": {
-	        "enabled": false
-	      },
-          "_all": {
-            "enabled": false
-          },
-	      "properties": {
-            "name": {
-              "type": "keyword",
-              "store": true
-            },
-	        "path": {
-	          "type": "text",
-              "analyzer": "path",
-              "store": true
-	        },
-	        "data": {
-	          "type": "text",
-	          "analyzer": "trigram",
-              "index_options": "docs"
-	        }
-	      }
-	    }
-	  }
+// DeleteFile deletes the single file at path from the index.
+func (idx *Index) DeleteFile(path string) error {
+	return idx.DeleteID(ID(path))
+}
+
+// Move updates the index after the file or directory at from has
+// been moved to to. Because the index doesn't store the indexed text,
+// files are read again from their new location, or from the stored
+// contents if available.
+func (idx *Index) Move(from, to string) (index.Statistics, error) {
+	from = filepath.Clean(from)
+	to = filepath.Clean(to)
+	var stats index.Statistics
+	if from == to {
+		return stats, nil
 	}
-	`
+	var moved []string
+	b := idx.backend()
+	w := b.NewWriter()
+	err := b.Files(from, idx.Config.StoreContent, func(hit SearchHit) error {
+		old := filepath.Join(hit.Path, hit.Name)
+		rest := strings.TrimPrefix(old, from)
+		if rest != "" && rest[0] != '/' && rest[0] != '\x00' {
+			// a sibling sharing a prefix, such as foo and foobar
+			return nil
+		}
+		path := to + rest
 
-	req, err := http.NewRequest("PUT", idx.Client.Base+"/"+idx.Client.Index, strings.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
+		var r io.ReadCloser
+		var err error
+		if hit.Content != nil {
+			r, err = hit.Open()
+		} else {
+			r, err = fs.Open(path)
+		}
+		if err != nil {
+			log.Printf("Couldn't move %q: %s", old, err)
+			stats.Skipped++
+			return nil
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			log.Printf("Couldn't move %q: %s", old, err)
+			stats.Skipped++
+			return nil
+		}
+		if Verbose {
+			log.Printf("Moving %q to %q", old, path)
+		}
+		doc, err := idx.document(path, b)
+		if err != nil {
+			return err
+		}
+		if err := w.Index(doc, ID(path)); err != nil {
+			return err
+		}
+		// Only drop the old entry once the file is indexed at
+		// its new location.
+		moved = append(moved, hit.ID)
+		return nil
+	})
+	indexed, failed, cerr := w.Close()
+	stats.Indexed, stats.Failed = indexed, failed
 	if err != nil {
-		return err
+		return stats, err
 	}
-	resp, err := idx.Client.Do(req)
-	if err != nil {
-		if err, ok := err.(es.APIError); ok {
-			if err.Err.Type == "resource_already_exists_exception" {
-				return nil
-			}
+	if cerr != nil {
+		return stats, cerr
+	}
+	if err := b.Commit(); err != nil {
+		return stats, err
+	}
+	failed, err = b.DeleteIDs(moved...)
+	stats.Failed += failed
+	return stats, err
+}
+
+// Copy rebuilds all documents in dst. The index doesn't store
+// documents in their original form, so they are built anew from the
+// stored contents or from the files on disk. Files that no longer
+// exist are skipped.
+func (idx *Index) Copy(dst *es.Client) (index.Statistics, error) {
+	var stats index.Statistics
+	bi := dst.BulkInsert()
+	bi.OnFailure = func(f es.BulkFailure) {
+		doc := f.Object.(Document)
+		log.Printf("Couldn't copy %q: %s", filepath.Join(doc.Path, doc.Name), f)
+	}
+	err := idx.backend().Files("/", true, func(hit SearchHit) error {
+		path := filepath.Join(hit.Path, hit.Name)
+		r, err := hit.Open()
+		if err != nil {
+			log.Printf("Couldn't copy %q: %s", path, err)
+			stats.Skipped++
+			return nil
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			log.Printf("Couldn't copy %q: %s", path, err)
+			stats.Skipped++
+			return nil
+		}
+		if Verbose {
+			log.Printf("Copying %q", path)
+		}
+		doc, err := idx.document(path, b)
+		if err != nil {
+			return err
 		}
-		return err
+		return bi.Index(doc, hit.ID)
+	})
+	if err != nil {
+		bi.Close()
+		return stats, err
+	}
+	err = bi.Close()
+	stats.Indexed = bi.Indexed
+	stats.Failed = bi.Failed
+	return stats, err
+}
+
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-	return nil
+	return buf.Bytes(), nil
 }
 
 func (idx *Index) Index(root string) (index.Statistics, error) {
-	numWorkers := 4
+	numWorkers := idx.Config.Workers
+	if numWorkers <= 0 {
+		numWorkers = 4
+	}
 	errCh := make(chan error, numWorkers)
 	workCh := make(chan fs.File)
 	wg := sync.WaitGroup{}
 	wg.Add(numWorkers)
 	indexedTotal := make([]int, numWorkers)
 	skippedTotal := make([]int, numWorkers)
+	failedTotal := make([]int, numWorkers)
+	b := idx.backend()
 
 	for i := 0; i < numWorkers; i++ {
 		i := i
 		go func() {
 			defer wg.Done()
-			bi := idx.Client.BulkInsert()
-			indexed := 0
+			w := b.NewWriter()
 			skipped := 0
 			for f := range workCh {
 				b, err := ioutil.ReadAll(f)
@@ -156,25 +256,25 @@ func (idx *Index) Index(root string) (index.Statistics, error) {
 				if Verbose {
 					log.Printf("Indexing %q", f.Name())
 				}
-				indexed++
-				doc := Document{
-					Data: string(b),
-					Name: filepath.Base(f.Name()),
-					Path: filepath.Dir(f.Name()),
+				doc, err := idx.document(f.Name(), b)
+				if err != nil {
+					errCh <- err
+					return
 				}
-				id := sha256.Sum256([]byte(f.Name()))
-				if err := bi.Index(doc, hex.EncodeToString(id[:])); err != nil {
+				if err := w.Index(doc, ID(f.Name())); err != nil {
 					errCh <- err
 					return
 				}
 			}
-			// XXX ensure bi is always closed
-			if err := bi.Close(); err != nil {
+			// XXX ensure w is always closed
+			indexed, failed, err := w.Close()
+			if err != nil {
 				errCh <- err
 				return
 			}
 			indexedTotal[i] = indexed
 			skippedTotal[i] = skipped
+			failedTotal[i] = failed
 		}()
 	}
 
@@ -265,78 +365,120 @@ func (idx *Index) Index(root string) (index.Statistics, error) {
 	close(workCh)
 	wg.Wait()
 
+	if err == nil {
+		select {
+		case err = <-errCh:
+		default:
+		}
+	}
+	if err == nil {
+		err = b.Commit()
+	}
 	if err != nil {
 		return index.Statistics{}, err
 	}
 
+	failed := 0
 	for _, count := range indexedTotal {
 		indexed += count
 	}
 	for _, count := range skippedTotal {
 		skipped += count
 	}
-	return index.Statistics{Indexed: indexed, Skipped: skipped}, nil
-}
-
-func queryToES(q *parser.Query) interface{} {
-	out := es.BoolQuery{}
-	switch q.Op {
-	case parser.QAll:
-		return map[string]interface{}{"match_all": struct{}{}}
-	case parser.QNone:
-		return map[string]interface{}{"match_none": struct{}{}}
-	case parser.QAnd:
-		for _, tri := range q.Trigram {
-			out.And = append(out.And, es.Term{Key: "data", Value: tri})
-		}
-		for _, sq := range q.Sub {
-			out.And = append(out.And, queryToES(sq))
-		}
-	case parser.QOr:
-		for _, tri := range q.Trigram {
-			out.Or = append(out.Or, es.Term{Key: "data", Value: tri})
-		}
-		for _, sq := range q.Sub {
-			out.Or = append(out.Or, queryToES(sq))
-		}
-	}
-	if len(out.Or) > 0 {
-		out.MinimumOr = 1
+	for _, count := range failedTotal {
+		failed += count
 	}
-	return out
+	return index.Statistics{Indexed: indexed, Skipped: skipped, Failed: failed}, nil
 }
 
 type SearchHit struct {
 	ID   string
 	Name string
 	Path string
+	// Gzip compressed content of the file, if it was stored in the
+	// index and requested.
+	Content []byte
+
+	// content fetches the stored content of the file, if the
+	// backend can do so on demand.
+	content func() ([]byte, error)
 }
 
-func (idx *Index) Search(q *parser.Query, count int) ([]SearchHit, error) {
-	s := es.Search{
-		Query:  queryToES(q),
-		Fields: []string{"name", "path"},
+// Open returns the content of the file. It uses the copy stored in
+// the index if there is one, and reads the file otherwise.
+func (hit SearchHit) Open() (io.ReadCloser, error) {
+	content := hit.Content
+	if content == nil && hit.content != nil {
+		var err error
+		content, err = hit.content()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if content == nil {
+		return fs.Open(filepath.Join(hit.Path, hit.Name))
 	}
-	hits, err := idx.Client.Search(s, count)
+	return gzip.NewReader(bytes.NewReader(content))
+}
+
+type SearchOptions struct {
+	// Only return files that are in, or below, one of these
+	// absolute paths. A path may also name a single file.
+	Paths []string
+	// Only return files whose base name matches this glob. Only *
+	// and ? are special, all other characters, including [ and \,
+	// match themselves.
+	Name string
+	// The query is for lower-cased text, as returned by
+	// parser.Grams.LowerRegexpQuery. Only supported by indices whose
+	// Info says so.
+	LowerCase bool
+}
+
+// Files calls fn for every file in the index that is in, or below,
+// root, or that is root.
+func (idx *Index) Files(root string, fn func(SearchHit) error) error {
+	return idx.backend().Files(root, false, fn)
+}
+
+func (idx *Index) Search(q *parser.Query, opts SearchOptions, count int) ([]SearchHit, error) {
+	q, err := idx.Plan(q, opts)
 	if err != nil {
 		return nil, err
 	}
+	return idx.backend().Search(q, opts, count)
+}
+
+func (idx *Index) CreateIndex() error {
+	return idx.backend().CreateIndex()
+}
+
+// Info describes the contents of an index.
+type Info struct {
+	// Lengths of the n-grams stored in the index. Queries have to
+	// be built for these lengths, which may differ from the
+	// configured ones until the index has been rebuilt.
+	Grams parser.Grams
+	// Whether the index supports queries for lower-cased text
+	LowerCase bool
+}
 
-	type fields struct {
-		Name []string `json:"name"`
-		Path []string `json:"path"`
+// Info describes the index, or the index that would be created if
+// it doesn't exist yet.
+func (idx *Index) Info() (Info, error) {
+	return idx.backend().Info()
+}
+
+// Outdated describes how the index differs from the configuration,
+// apart from its schema version. It returns the empty string if it
+// doesn't.
+func (idx *Index) Outdated() (string, error) {
+	info, err := idx.Info()
+	if err != nil {
+		return "", err
 	}
-	out := make([]SearchHit, len(hits))
-	for i, hit := range hits {
-		var f fields
-		if err := json.Unmarshal(hit.Fields, &f); err != nil {
-			return nil, err
-		}
-		out[i] = SearchHit{
-			ID:   hit.ID,
-			Name: f.Name[0],
-			Path: f.Path[0],
-		}
+	if have, want := info.Grams, idx.grams(); have != want {
+		return fmt.Sprintf("the index contains %s, but the configuration asks for %s", have, want), nil
 	}
-	return out, nil
+	return "", nil
 }
@@ -0,0 +1,93 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"honnef.co/go/idxgrep/es"
+)
+
+// schemaKey is the key in an index's _meta field that stores the
+// version of the index's schema.
+const schemaKey = "idxgrep_schema"
+
+// VersionedName returns the name of the index that holds version
+// version of the schema, for the index alias alias.
+func VersionedName(alias string, version int) string {
+	return fmt.Sprintf("%s_v%d", alias, version)
+}
+
+// WithSchema records version in the _meta field of mappings,
+// keeping any other entries of the field.
+func WithSchema(mappings string, version int) (json.RawMessage, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(mappings), &m); err != nil {
+		return nil, err
+	}
+	meta, _ := m["_meta"].(map[string]interface{})
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	meta[schemaKey] = version
+	m["_meta"] = meta
+	return json.Marshal(m)
+}
+
+// Schema returns the schema version of the client's index and
+// whether the index exists at all. Indices created before schemas
+// were versioned have version 0.
+func Schema(client *es.Client) (version int, exists bool, err error) {
+	meta, err := client.Meta()
+	if err != nil {
+		if err, ok := err.(es.APIError); ok && err.Err.Type == "index_not_found_exception" {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	version, err = SchemaOf(meta)
+	return version, true, err
+}
+
+// SchemaOf returns the schema version recorded in the _meta field
+// meta of an index's mapping.
+func SchemaOf(meta map[string]json.RawMessage) (int, error) {
+	var version int
+	if b, ok := meta[schemaKey]; ok {
+		if err := json.Unmarshal(b, &version); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// Create creates a new index, named after the schema version, with
+// the client's index as its alias. If the index already exists, Create
+// warns if its schema version differs from version, and returns false.
+func Create(client *es.Client, settings, mappings string, version int) (bool, error) {
+	have, exists, err := Schema(client)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		if have != version {
+			log.Printf("Index %q uses schema version %d, but version %d is current; run 'idxadmin migrate' to upgrade it",
+				client.Index, have, version)
+		}
+		return false, nil
+	}
+	name := VersionedName(client.Index, version)
+	if err := CreateVersion(client, name, settings, mappings, version, client.Index); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CreateVersion creates the named index with the given aliases.
+func CreateVersion(client *es.Client, name, settings, mappings string, version int, aliases ...string) error {
+	m, err := WithSchema(mappings, version)
+	if err != nil {
+		return err
+	}
+	return client.CreateIndex(name, json.RawMessage(settings), m, aliases...)
+}
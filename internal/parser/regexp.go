@@ -5,6 +5,7 @@
 package parser
 
 import (
+	"fmt"
 	"regexp/syntax"
 	"sort"
 	"strconv"
@@ -19,6 +20,9 @@ import (
 // quite a bit more.  We can then filter target files by whether they match
 // the Query (using a trigram index) before running the comparatively
 // more expensive regexp machinery.
+//
+// Despite its name, Trigram holds n-grams of the sizes described by
+// the Grams used to create the Query.
 type Query struct {
 	Op      QueryOp
 	Trigram []string
@@ -34,9 +38,31 @@ const (
 	QOr                  // At least one in Sub or Trigram must match
 )
 
+// Grams describes the n-grams stored in an index: all substrings of
+// Min to Max bytes.
+type Grams struct {
+	Min int
+	Max int
+}
+
+// Trigrams describes an index of trigrams.
+var Trigrams = Grams{3, 3}
+
+func (g Grams) String() string {
+	if g.Min == g.Max {
+		return fmt.Sprintf("%d-grams", g.Max)
+	}
+	return fmt.Sprintf("%d- to %d-grams", g.Min, g.Max)
+}
+
 var allQuery = &Query{Op: QAll}
 var noneQuery = &Query{Op: QNone}
 
+// And returns the query q AND r, possibly reusing q's and r's storage.
+func (q *Query) And(r *Query) *Query {
+	return q.and(r)
+}
+
 // and returns the query q AND r, possibly reusing q's and r's storage.
 func (q *Query) and(r *Query) *Query {
 	return q.andOr(r, QAnd)
@@ -214,11 +240,12 @@ func trigramsImply(t []string, q *Query) bool {
 	return false
 }
 
-// andTrigrams returns q AND the OR of the AND of the trigrams present in each string.
-func (q *Query) andTrigrams(t stringSet) *Query {
-	if t.minLen() < 3 {
+// andTrigrams returns q AND the OR of the AND of the n-grams present in each string.
+// Strings shorter than g.Max are n-grams themselves.
+func (q *Query) andTrigrams(g Grams, t stringSet) *Query {
+	if t.minLen() < g.Min {
 		// If there is a short string, we can't guarantee
-		// that any trigrams must be present, so use ALL.
+		// that any n-grams must be present, so use ALL.
 		// q AND ALL = q.
 		return q
 	}
@@ -226,8 +253,11 @@ func (q *Query) andTrigrams(t stringSet) *Query {
 	or := noneQuery
 	for _, tt := range t {
 		var trig stringSet
-		for i := 0; i+3 <= len(tt); i++ {
-			trig.add(tt[i : i+3])
+		if len(tt) < g.Max {
+			trig.add(tt)
+		}
+		for i := 0; i+g.Max <= len(tt); i++ {
+			trig.add(tt[i : i+g.Max])
 		}
 		trig.clean(false)
 		or = or.or(&Query{Op: QAnd, Trigram: trig})
@@ -285,11 +315,68 @@ func (q *Query) String() string {
 	return s
 }
 
-// RegexpQuery returns a Query for the given regexp.
+// RegexpQuery returns a Query of trigrams for the given regexp.
 func RegexpQuery(re *syntax.Regexp) *Query {
-	info := analyze(re)
-	info.simplify(true)
-	info.addExact()
+	return Trigrams.RegexpQuery(re)
+}
+
+// LiteralQuery returns a Query of trigrams for text containing at
+// least one of the literal strings in lits.
+func LiteralQuery(lits []string) *Query {
+	return Trigrams.LiteralQuery(lits)
+}
+
+// RegexpQuery returns a Query for the given regexp.
+func (g Grams) RegexpQuery(re *syntax.Regexp) *Query {
+	return analyzer{Grams: g}.query(re)
+}
+
+// LiteralQuery returns a Query for text containing at least one of
+// the literal strings in lits. Unlike the Query for an alternation of
+// the literals, it stays exact for large numbers of strings.
+func (g Grams) LiteralQuery(lits []string) *Query {
+	t := stringSet(append([]string{}, lits...))
+	t.clean(false)
+	return allQuery.andTrigrams(g, t)
+}
+
+// LowerRegexpQuery returns a Query for the given regexp, for use
+// with an index of lower-cased text. Case-insensitive parts of the
+// regexp don't have to be expanded into all their case variants,
+// which keeps the Query small.
+func (g Grams) LowerRegexpQuery(re *syntax.Regexp) *Query {
+	return analyzer{Grams: g, lower: true}.query(re)
+}
+
+// LowerLiteralQuery is like LiteralQuery, for use with an index of
+// lower-cased text.
+func (g Grams) LowerLiteralQuery(lits []string) *Query {
+	t := make(stringSet, len(lits))
+	for i, lit := range lits {
+		t[i] = toLower(lit)
+	}
+	t.clean(false)
+	return allQuery.andTrigrams(g, t)
+}
+
+// toLower maps each rune in s to lower case, the way Elasticsearch's
+// lowercase token filter does.
+func toLower(s string) string {
+	return strings.Map(unicode.ToLower, s)
+}
+
+// An analyzer computes Queries for regexps.
+type analyzer struct {
+	Grams
+	// lower makes the analyzer compute Queries for lower-cased
+	// text.
+	lower bool
+}
+
+func (g analyzer) query(re *syntax.Regexp) *Query {
+	info := g.analyze(re)
+	info.simplify(g.Grams, true)
+	info.addExact(g.Grams)
 	return info.match
 }
 
@@ -373,7 +460,7 @@ func emptyString() regexpInfo {
 }
 
 // analyze returns the regexpInfo for the regexp re.
-func analyze(re *syntax.Regexp) (ret regexpInfo) {
+func (g analyzer) analyze(re *syntax.Regexp) (ret regexpInfo) {
 	//println("analyze", re.String())
 	//defer func() { println("->", ret.String()) }()
 	var info regexpInfo
@@ -404,7 +491,7 @@ func analyze(re *syntax.Regexp) (ret regexpInfo) {
 				for r1 := unicode.SimpleFold(r0); r1 != r0; r1 = unicode.SimpleFold(r1) {
 					re1.Rune = append(re1.Rune, r1, r1)
 				}
-				info = analyze(re1)
+				info = g.analyze(re1)
 				return info
 			}
 			// Multi-letter case-folded string:
@@ -416,27 +503,30 @@ func analyze(re *syntax.Regexp) (ret regexpInfo) {
 			info = emptyString()
 			for i := range re.Rune {
 				re1.Rune = re.Rune[i : i+1]
-				info = concat(info, analyze(re1))
+				info = g.concat(info, g.analyze(re1))
 			}
 			return info
 		}
 		info.exact = stringSet{string(re.Rune)}
+		if g.lower {
+			info.exact[0] = toLower(info.exact[0])
+		}
 		info.match = allQuery
 
 	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
 		return anyChar()
 
 	case syntax.OpCapture:
-		return analyze(re.Sub[0])
+		return g.analyze(re.Sub[0])
 
 	case syntax.OpConcat:
-		return fold(concat, re.Sub, emptyString())
+		return g.fold(g.concat, re.Sub, emptyString())
 
 	case syntax.OpAlternate:
-		return fold(alternate, re.Sub, noMatch())
+		return g.fold(g.alternate, re.Sub, noMatch())
 
 	case syntax.OpQuest:
-		return alternate(analyze(re.Sub[0]), emptyString())
+		return g.alternate(g.analyze(re.Sub[0]), emptyString())
 
 	case syntax.OpStar:
 		// We don't know anything, so assume the worst.
@@ -452,7 +542,7 @@ func analyze(re *syntax.Regexp) (ret regexpInfo) {
 		// x+
 		// Since there has to be at least one x, the prefixes and suffixes
 		// stay the same.  If x was exact, it isn't anymore.
-		info = analyze(re.Sub[0])
+		info = g.analyze(re.Sub[0])
 		if info.exact.have() {
 			info.prefix = info.exact
 			info.suffix = info.exact.copy()
@@ -470,6 +560,9 @@ func analyze(re *syntax.Regexp) (ret regexpInfo) {
 		// Special case.
 		if len(re.Rune) == 1 {
 			info.exact = stringSet{string(re.Rune[0])}
+			if g.lower {
+				info.exact[0] = toLower(info.exact[0])
+			}
 			break
 		}
 
@@ -486,32 +579,39 @@ func analyze(re *syntax.Regexp) (ret regexpInfo) {
 		for i := 0; i < len(re.Rune); i += 2 {
 			lo, hi := re.Rune[i], re.Rune[i+1]
 			for rr := lo; rr <= hi; rr++ {
+				if g.lower {
+					// Case variants collapse into one
+					// string, duplicates are removed
+					// by simplify.
+					info.exact.add(string(unicode.ToLower(rr)))
+					continue
+				}
 				info.exact.add(string(rr))
 			}
 		}
 	}
 
-	info.simplify(false)
+	info.simplify(g.Grams, false)
 	return info
 }
 
 // fold is the usual higher-order function.
-func fold(f func(x, y regexpInfo) regexpInfo, sub []*syntax.Regexp, zero regexpInfo) regexpInfo {
+func (g analyzer) fold(f func(x, y regexpInfo) regexpInfo, sub []*syntax.Regexp, zero regexpInfo) regexpInfo {
 	if len(sub) == 0 {
 		return zero
 	}
 	if len(sub) == 1 {
-		return analyze(sub[0])
+		return g.analyze(sub[0])
 	}
-	info := f(analyze(sub[0]), analyze(sub[1]))
+	info := f(g.analyze(sub[0]), g.analyze(sub[1]))
 	for i := 2; i < len(sub); i++ {
-		info = f(info, analyze(sub[i]))
+		info = f(info, g.analyze(sub[i]))
 	}
 	return info
 }
 
 // concat returns the regexp info for xy given x and y.
-func concat(x, y regexpInfo) (out regexpInfo) {
+func (g analyzer) concat(x, y regexpInfo) (out regexpInfo) {
 	var xy regexpInfo
 	xy.match = x.match.and(y.match)
 	if x.exact.have() && y.exact.have() {
@@ -536,33 +636,33 @@ func concat(x, y regexpInfo) (out regexpInfo) {
 	}
 
 	// If all the possible strings in the cross product of x.suffix
-	// and y.prefix are long enough, then the trigram for one
+	// and y.prefix are long enough, then the n-gram for one
 	// of them must be present and would not necessarily be
 	// accounted for in xy.prefix or xy.suffix yet.  Cut things off
 	// at maxSet just to keep the sets manageable.
 	if !x.exact.have() && !y.exact.have() &&
 		x.suffix.size() <= maxSet && y.prefix.size() <= maxSet &&
-		x.suffix.minLen()+y.prefix.minLen() >= 3 {
-		xy.match = xy.match.andTrigrams(x.suffix.cross(y.prefix, false))
+		x.suffix.minLen()+y.prefix.minLen() >= g.Min {
+		xy.match = xy.match.andTrigrams(g.Grams, x.suffix.cross(y.prefix, false))
 	}
 
-	xy.simplify(false)
+	xy.simplify(g.Grams, false)
 	return xy
 }
 
 // alternate returns the regexpInfo for x|y given x and y.
-func alternate(x, y regexpInfo) (out regexpInfo) {
+func (g analyzer) alternate(x, y regexpInfo) (out regexpInfo) {
 	var xy regexpInfo
 	if x.exact.have() && y.exact.have() {
 		xy.exact = x.exact.union(y.exact, false)
 	} else if x.exact.have() {
 		xy.prefix = x.exact.union(y.prefix, false)
 		xy.suffix = x.exact.union(y.suffix, true)
-		x.addExact()
+		x.addExact(g.Grams)
 	} else if y.exact.have() {
 		xy.prefix = x.prefix.union(y.exact, false)
 		xy.suffix = x.suffix.union(y.exact.copy(), true)
-		y.addExact()
+		y.addExact(g.Grams)
 	} else {
 		xy.prefix = x.prefix.union(y.prefix, false)
 		xy.suffix = x.suffix.union(y.suffix, true)
@@ -570,57 +670,57 @@ func alternate(x, y regexpInfo) (out regexpInfo) {
 	xy.canEmpty = x.canEmpty || y.canEmpty
 	xy.match = x.match.or(y.match)
 
-	xy.simplify(false)
+	xy.simplify(g.Grams, false)
 	return xy
 }
 
-// addExact adds to the match query the trigrams for matching info.exact.
-func (info *regexpInfo) addExact() {
+// addExact adds to the match query the n-grams for matching info.exact.
+func (info *regexpInfo) addExact(g Grams) {
 	if info.exact.have() {
-		info.match = info.match.andTrigrams(info.exact)
+		info.match = info.match.andTrigrams(g, info.exact)
 	}
 }
 
 // simplify simplifies the regexpInfo when the exact set gets too large.
-func (info *regexpInfo) simplify(force bool) {
+func (info *regexpInfo) simplify(g Grams, force bool) {
 	// If there are now too many exact strings,
-	// loop over them, adding trigrams and moving
+	// loop over them, adding n-grams and moving
 	// the relevant pieces into prefix and suffix.
 	info.exact.clean(false)
-	if len(info.exact) > maxExact || (info.exact.minLen() >= 3 && force) || info.exact.minLen() >= 4 {
-		info.addExact()
+	if len(info.exact) > maxExact || (info.exact.minLen() >= g.Min && force) || info.exact.minLen() > g.Max {
+		info.addExact(g)
 		for _, s := range info.exact {
 			n := len(s)
-			if n < 3 {
+			if n < g.Max {
 				info.prefix.add(s)
 				info.suffix.add(s)
 			} else {
-				info.prefix.add(s[:2])
-				info.suffix.add(s[n-2:])
+				info.prefix.add(s[:g.Max-1])
+				info.suffix.add(s[n-g.Max+1:])
 			}
 		}
 		info.exact = nil
 	}
 
 	if !info.exact.have() {
-		info.simplifySet(&info.prefix)
-		info.simplifySet(&info.suffix)
+		info.simplifySet(g, &info.prefix)
+		info.simplifySet(g, &info.suffix)
 	}
 }
 
 // simplifySet reduces the size of the given set (either prefix or suffix).
 // There is no need to pass around enormous prefix or suffix sets, since
-// they will only be used to create trigrams.  As they get too big, simplifySet
+// they will only be used to create n-grams.  As they get too big, simplifySet
 // moves the information they contain into the match query, which is
 // more efficient to pass around.
-func (info *regexpInfo) simplifySet(s *stringSet) {
+func (info *regexpInfo) simplifySet(g Grams, s *stringSet) {
 	t := *s
 	t.clean(s == &info.suffix)
 
 	// Add the OR of the current prefix/suffix set to the query.
-	info.match = info.match.andTrigrams(t)
+	info.match = info.match.andTrigrams(g, t)
 
-	for n := 3; n == 3 || t.size() > maxSet; n-- {
+	for n := g.Max; n == g.Max || t.size() > maxSet; n-- {
 		// Replace set by strings of length n-1.
 		w := 0
 		for _, str := range t {
@@ -0,0 +1,78 @@
+package parser
+
+import (
+	"regexp/syntax"
+	"testing"
+)
+
+func TestGramsRegexpQuery(t *testing.T) {
+	tests := []struct {
+		g    Grams
+		re   string
+		want string
+	}{
+		{Trigrams, "hello", `"ell" "hel" "llo"`},
+		{Trigrams, "ab", `+`},
+		{Trigrams, "x[yz]w", `("xyw"|"xzw")`},
+		{Grams{2, 2}, "ab", `"ab"`},
+		{Grams{2, 2}, "hello", `"el" "he" "ll" "lo"`},
+		{Grams{2, 2}, "foo.*bar", `"ar" "ba" "fo" "oo"`},
+		{Grams{2, 3}, "ab", `"ab"`},
+		{Grams{2, 3}, "(?i)ab", `("AB"|"Ab"|"aB"|"ab")`},
+		{Grams{4, 4}, "hello", `"ello" "hell"`},
+		{Grams{4, 4}, "foo.*bar", `+`},
+		{Grams{2, 4}, "abc|de", `("abc"|"de")`},
+	}
+	for _, tt := range tests {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.g.RegexpQuery(re.Simplify()).String(); got != tt.want {
+			t.Errorf("%s: RegexpQuery(%q) = %s, want %s", tt.g, tt.re, got, tt.want)
+		}
+	}
+}
+
+func TestGramsLiteralQuery(t *testing.T) {
+	tests := []struct {
+		g    Grams
+		lits []string
+		want string
+	}{
+		{Trigrams, []string{"hello", "ab"}, `+`},
+		{Grams{2, 3}, []string{"hello", "ab"}, `("ab")|("ell" "hel" "llo")`},
+		{Grams{2, 3}, []string{"abcd"}, `"abc" "bcd"`},
+	}
+	for _, tt := range tests {
+		if got := tt.g.LiteralQuery(tt.lits).String(); got != tt.want {
+			t.Errorf("%s: LiteralQuery(%q) = %s, want %s", tt.g, tt.lits, got, tt.want)
+		}
+	}
+}
+
+func TestLowerRegexpQuery(t *testing.T) {
+	tests := []struct {
+		re   string
+		want string
+	}{
+		{"(?i)hello", `"ell" "hel" "llo"`},
+		{"Hello", `"ell" "hel" "llo"`},
+		{"(?i)[a-c]xy", `("axy"|"bxy"|"cxy")`},
+		// K, k and the Kelvin sign all become k.
+		{"(?i)kit", `"kit"`},
+	}
+	for _, tt := range tests {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Trigrams.LowerRegexpQuery(re.Simplify()).String(); got != tt.want {
+			t.Errorf("LowerRegexpQuery(%q) = %s, want %s", tt.re, got, tt.want)
+		}
+	}
+
+	if got, want := Trigrams.LowerLiteralQuery([]string{"HeLLo"}).String(), `"ell" "hel" "llo"`; got != want {
+		t.Errorf("LowerLiteralQuery = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,588 @@
+// Package posting implements an on-disk trigram index, in the spirit
+// of codesearch's index format.
+//
+// An index file consists of a list of documents, followed by a
+// posting list for each trigram that occurs in any document, listing
+// the documents containing it. Two tables at the end of the file map
+// document numbers and trigrams to their locations. All integers in
+// the tables are big endian, posting lists are delta encoded
+// varints.
+//
+// Index files are never modified in place. Adding and removing
+// documents merges the old file and the changes into a new file,
+// which then replaces the old one.
+package posting
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+const (
+	magic        = "idxgrep trigram index 1\n"
+	trailerMagic = "\nidxgrep trailer\n"
+	// docIndexOff, numDocs, postIndexOff, numTrigrams, magic
+	trailerSize   = 8 + 4 + 8 + 4 + len(trailerMagic)
+	postEntrySize = 4 + 4 + 8
+)
+
+var ErrCorrupt = errors.New("corrupt index file")
+
+// Doc is a document stored in the index.
+type Doc struct {
+	ID   string
+	Path string
+	Name string
+	// Optional, opaque copy of the document's content.
+	Content []byte
+}
+
+// Trigram returns the numeric representation of the three bytes in
+// s.
+func Trigram(s string) uint32 {
+	return uint32(s[0])<<16 | uint32(s[1])<<8 | uint32(s[2])
+}
+
+// Reader reads an index file.
+type Reader struct {
+	f            *os.File
+	numDocs      int
+	numTrigrams  int
+	docIndexOff  int64
+	postIndexOff int64
+}
+
+// Open opens the index file at path. A missing file is treated as
+// an empty index.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Reader{}, nil
+		}
+		return nil, err
+	}
+	r := &Reader{f: f}
+	if err := r.readTrailer(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return r, nil
+}
+
+func (r *Reader) readTrailer() error {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < int64(len(magic)+trailerSize) {
+		return ErrCorrupt
+	}
+	buf := make([]byte, trailerSize)
+	if _, err := r.f.ReadAt(buf, fi.Size()-int64(trailerSize)); err != nil {
+		return err
+	}
+	if string(buf[24:]) != trailerMagic {
+		return ErrCorrupt
+	}
+	r.docIndexOff = int64(binary.BigEndian.Uint64(buf[0:]))
+	r.numDocs = int(binary.BigEndian.Uint32(buf[8:]))
+	r.postIndexOff = int64(binary.BigEndian.Uint64(buf[12:]))
+	r.numTrigrams = int(binary.BigEndian.Uint32(buf[20:]))
+	return nil
+}
+
+func (r *Reader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// NumDocs returns the number of documents in the index.
+func (r *Reader) NumDocs() int {
+	return r.numDocs
+}
+
+func (r *Reader) uint64At(off int64) (uint64, error) {
+	var buf [8]byte
+	if _, err := r.f.ReadAt(buf[:], off); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// Doc returns document number i.
+func (r *Reader) Doc(i uint32) (Doc, error) {
+	if int(i) >= r.numDocs {
+		return Doc{}, fmt.Errorf("document %d out of range", i)
+	}
+	off, err := r.uint64At(r.docIndexOff + 8*int64(i))
+	if err != nil {
+		return Doc{}, err
+	}
+	if off > uint64(r.docIndexOff) {
+		return Doc{}, ErrCorrupt
+	}
+	// Bytes left in the documents section, bounding the length of
+	// the fields
+	left := r.docIndexOff - int64(off)
+	br := bufio.NewReader(io.NewSectionReader(r.f, int64(off), left))
+	var fields [4][]byte
+	for j := range fields {
+		n, err := binary.ReadUvarint(br)
+		if err != nil || n > uint64(left) {
+			return Doc{}, ErrCorrupt
+		}
+		left -= int64(n)
+		fields[j] = make([]byte, n)
+		if _, err := io.ReadFull(br, fields[j]); err != nil {
+			return Doc{}, ErrCorrupt
+		}
+	}
+	doc := Doc{
+		ID:   string(fields[0]),
+		Path: string(fields[1]),
+		Name: string(fields[2]),
+	}
+	if len(fields[3]) > 0 {
+		doc.Content = fields[3]
+	}
+	return doc, nil
+}
+
+type postEntry struct {
+	trigram uint32
+	count   uint32
+	offset  uint64
+}
+
+func (r *Reader) postEntry(i int) (postEntry, error) {
+	var buf [postEntrySize]byte
+	if _, err := r.f.ReadAt(buf[:], r.postIndexOff+int64(i)*postEntrySize); err != nil {
+		return postEntry{}, err
+	}
+	return postEntry{
+		trigram: binary.BigEndian.Uint32(buf[0:]),
+		count:   binary.BigEndian.Uint32(buf[4:]),
+		offset:  binary.BigEndian.Uint64(buf[8:]),
+	}, nil
+}
+
+func (r *Reader) readPostings(e postEntry) ([]uint32, error) {
+	left := r.docIndexOff - int64(e.offset)
+	// Every posting takes at least one byte.
+	if e.offset > uint64(r.docIndexOff) || int64(e.count) > left {
+		return nil, ErrCorrupt
+	}
+	br := bufio.NewReader(io.NewSectionReader(r.f, int64(e.offset), left))
+	out := make([]uint32, 0, e.count)
+	doc := int64(-1)
+	for i := uint32(0); i < e.count; i++ {
+		delta, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		doc += int64(delta) + 1
+		out = append(out, uint32(doc))
+	}
+	return out, nil
+}
+
+// lookup finds the posting index entry of the trigram.
+func (r *Reader) lookup(trigram uint32) (postEntry, bool, error) {
+	var err error
+	i := sort.Search(r.numTrigrams, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var e postEntry
+		e, err = r.postEntry(i)
+		return e.trigram >= trigram
+	})
+	if err != nil || i == r.numTrigrams {
+		return postEntry{}, false, err
+	}
+	e, err := r.postEntry(i)
+	if err != nil || e.trigram != trigram {
+		return postEntry{}, false, err
+	}
+	return e, true, nil
+}
+
+// PostingList returns the sorted numbers of all documents that
+// contain the trigram.
+func (r *Reader) PostingList(trigram uint32) ([]uint32, error) {
+	e, ok, err := r.lookup(trigram)
+	if !ok {
+		return nil, err
+	}
+	return r.readPostings(e)
+}
+
+// DocFreq returns the number of documents that contain the trigram,
+// without reading its posting list.
+func (r *Reader) DocFreq(trigram uint32) (int, error) {
+	e, _, err := r.lookup(trigram)
+	return int(e.count), err
+}
+
+func (r *Reader) all() []uint32 {
+	out := make([]uint32, r.numDocs)
+	for i := range out {
+		out[i] = uint32(i)
+	}
+	return out
+}
+
+// PostingQuery returns the sorted numbers of all documents that may
+// match the query.
+func (r *Reader) PostingQuery(q *parser.Query) ([]uint32, error) {
+	switch q.Op {
+	case parser.QNone:
+		return nil, nil
+	case parser.QAll:
+		return r.all(), nil
+	case parser.QAnd:
+		var list []uint32
+		first := true
+		for _, t := range q.Trigram {
+			l, err := r.PostingList(Trigram(t))
+			if err != nil {
+				return nil, err
+			}
+			if first {
+				list, first = l, false
+			} else {
+				list = intersect(list, l)
+			}
+			if len(list) == 0 {
+				return nil, nil
+			}
+		}
+		for _, sub := range q.Sub {
+			l, err := r.PostingQuery(sub)
+			if err != nil {
+				return nil, err
+			}
+			if first {
+				list, first = l, false
+			} else {
+				list = intersect(list, l)
+			}
+			if len(list) == 0 {
+				return nil, nil
+			}
+		}
+		if first {
+			return r.all(), nil
+		}
+		return list, nil
+	case parser.QOr:
+		var list []uint32
+		for _, t := range q.Trigram {
+			l, err := r.PostingList(Trigram(t))
+			if err != nil {
+				return nil, err
+			}
+			list = union(list, l)
+		}
+		for _, sub := range q.Sub {
+			l, err := r.PostingQuery(sub)
+			if err != nil {
+				return nil, err
+			}
+			list = union(list, l)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unknown query operation %d", q.Op)
+}
+
+func intersect(a, b []uint32) []uint32 {
+	var out []uint32
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			out = append(out, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return out
+}
+
+func union(a, b []uint32) []uint32 {
+	out := make([]uint32, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			out = append(out, a[0])
+			a = a[1:]
+		case a[0] > b[0]:
+			out = append(out, b[0])
+			b = b[1:]
+		default:
+			out = append(out, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
+
+// Segment collects new documents in memory, until they are merged
+// into an index file.
+type Segment struct {
+	docs []Doc
+	post map[uint32][]uint32
+}
+
+// Add adds a document with the given data to the segment. Adding a
+// document whose ID is already in the segment replaces it.
+func (s *Segment) Add(doc Doc, data []byte) {
+	if s.post == nil {
+		s.post = map[uint32][]uint32{}
+	}
+	n := uint32(len(s.docs))
+	s.docs = append(s.docs, doc)
+	seen := map[uint32]struct{}{}
+	for i := 0; i+3 <= len(data); i++ {
+		t := uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		s.post[t] = append(s.post[t], n)
+	}
+}
+
+// Len returns the number of documents in the segment.
+func (s *Segment) Len() int {
+	return len(s.docs)
+}
+
+// Merge writes a new index file to path, containing the documents of
+// old for which drop returns false, followed by the documents of seg.
+// Documents in old are dropped automatically if seg contains a
+// document with the same ID. old and seg may be nil. Merge returns
+// the number of documents that were dropped.
+func Merge(path string, old *Reader, seg *Segment, drop func(Doc) bool) (int, error) {
+	if old == nil {
+		old = &Reader{}
+	}
+	if seg == nil {
+		seg = &Segment{}
+	}
+	// Later documents in the segment replace earlier ones.
+	ids := map[string]uint32{}
+	for i, doc := range seg.docs {
+		ids[doc.ID] = uint32(i)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w := &countWriter{w: bufio.NewWriter(f)}
+	w.WriteString(magic)
+
+	// Old documents that are kept get renumbered, documents from the
+	// segment follow them.
+	var offsets []uint64
+	oldMap := make([]int64, old.numDocs)
+	dropped := 0
+	for i := 0; i < old.numDocs; i++ {
+		doc, err := old.Doc(uint32(i))
+		if err != nil {
+			return 0, err
+		}
+		_, replaced := ids[doc.ID]
+		if replaced || (drop != nil && drop(doc)) {
+			oldMap[i] = -1
+			if !replaced {
+				dropped++
+			}
+			continue
+		}
+		oldMap[i] = int64(len(offsets))
+		offsets = append(offsets, uint64(w.n))
+		w.writeDoc(doc)
+	}
+	segMap := make([]int64, len(seg.docs))
+	for i, doc := range seg.docs {
+		if ids[doc.ID] != uint32(i) {
+			segMap[i] = -1
+			continue
+		}
+		segMap[i] = int64(len(offsets))
+		offsets = append(offsets, uint64(w.n))
+		w.writeDoc(doc)
+	}
+
+	// Merge posting lists in trigram order.
+	trigrams := make([]uint32, 0, len(seg.post))
+	for t := range seg.post {
+		trigrams = append(trigrams, t)
+	}
+	sort.Slice(trigrams, func(i, j int) bool { return trigrams[i] < trigrams[j] })
+	var entries []postEntry
+	var list []uint32
+	emit := func(t uint32) {
+		if len(list) == 0 {
+			return
+		}
+		entries = append(entries, postEntry{t, uint32(len(list)), uint64(w.n)})
+		prev := int64(-1)
+		for _, doc := range list {
+			w.writeUvarint(uint64(int64(doc) - prev - 1))
+			prev = int64(doc)
+		}
+	}
+	oi, si := 0, 0
+	for oi < old.numTrigrams || si < len(trigrams) {
+		var oe postEntry
+		if oi < old.numTrigrams {
+			oe, err = old.postEntry(oi)
+			if err != nil {
+				return 0, err
+			}
+		}
+		list = list[:0]
+		var t uint32
+		switch {
+		case si == len(trigrams) || (oi < old.numTrigrams && oe.trigram < trigrams[si]):
+			t = oe.trigram
+		case oi == old.numTrigrams || trigrams[si] < oe.trigram:
+			t = trigrams[si]
+		default:
+			t = oe.trigram
+		}
+		if oi < old.numTrigrams && oe.trigram == t {
+			docs, err := old.readPostings(oe)
+			if err != nil {
+				return 0, err
+			}
+			for _, doc := range docs {
+				if n := oldMap[doc]; n >= 0 {
+					list = append(list, uint32(n))
+				}
+			}
+			oi++
+		}
+		if si < len(trigrams) && trigrams[si] == t {
+			for _, doc := range seg.post[t] {
+				if n := segMap[doc]; n >= 0 {
+					list = append(list, uint32(n))
+				}
+			}
+			si++
+		}
+		emit(t)
+	}
+
+	docIndexOff := w.n
+	for _, off := range offsets {
+		w.writeUint64(off)
+	}
+	postIndexOff := w.n
+	for _, e := range entries {
+		w.writeUint32(e.trigram)
+		w.writeUint32(e.count)
+		w.writeUint64(e.offset)
+	}
+	w.writeUint64(uint64(docIndexOff))
+	w.writeUint32(uint32(len(offsets)))
+	w.writeUint64(uint64(postIndexOff))
+	w.writeUint32(uint32(len(entries)))
+	w.WriteString(trailerMagic)
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	name := f.Name()
+	f = nil
+	if err := os.Rename(name, path); err != nil {
+		os.Remove(name)
+		return 0, err
+	}
+	return dropped, nil
+}
+
+// countWriter keeps track of the number of bytes written and of the
+// first error.
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *countWriter) WriteString(s string) {
+	w.Write([]byte(s))
+}
+
+func (w *countWriter) writeUvarint(x uint64) {
+	n := binary.PutUvarint(w.buf[:], x)
+	w.Write(w.buf[:n])
+}
+
+func (w *countWriter) writeUint32(x uint32) {
+	binary.BigEndian.PutUint32(w.buf[:], x)
+	w.Write(w.buf[:4])
+}
+
+func (w *countWriter) writeUint64(x uint64) {
+	binary.BigEndian.PutUint64(w.buf[:], x)
+	w.Write(w.buf[:8])
+}
+
+func (w *countWriter) writeDoc(doc Doc) {
+	for _, field := range [][]byte{[]byte(doc.ID), []byte(doc.Path), []byte(doc.Name), doc.Content} {
+		w.writeUvarint(uint64(len(field)))
+		w.Write(field)
+	}
+}
@@ -0,0 +1,205 @@
+package posting
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"sort"
+	"testing"
+
+	"honnef.co/go/idxgrep/internal/parser"
+)
+
+func ids(t *testing.T, r *Reader, docs []uint32) []string {
+	t.Helper()
+	var out []string
+	for _, d := range docs {
+		doc, err := r.Doc(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, doc.ID)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func query(t *testing.T, path string, re string) []string {
+	t.Helper()
+	sre, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := parser.RegexpQuery(sre)
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	docs, err := r.PostingQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids(t, r, docs)
+}
+
+func merge(t *testing.T, path string, seg *Segment, drop func(Doc) bool) int {
+	t.Helper()
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	n, err := Merge(path, r, seg, drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+
+	if got := query(t, path, "hello"); got != nil {
+		t.Errorf("missing index: got %q, want no documents", got)
+	}
+
+	seg := &Segment{}
+	seg.Add(Doc{ID: "a", Path: "/src", Name: "a.go", Content: []byte("compressed")}, []byte("hello world"))
+	seg.Add(Doc{ID: "b", Path: "/src", Name: "b.go"}, []byte("goodbye world"))
+	merge(t, path, seg, nil)
+
+	tests := []struct {
+		re   string
+		want []string
+	}{
+		{"hello", []string{"a"}},
+		{"world", []string{"a", "b"}},
+		{"hello|goodbye", []string{"a", "b"}},
+		{"hello.*world", []string{"a"}},
+		{"missing", nil},
+		{"a", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := query(t, path, tt.re); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.re, got, tt.want)
+		}
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tri, want := range map[string]int{"wor": 2, "hel": 1, "zzz": 0} {
+		if got, err := r.DocFreq(Trigram(tri)); err != nil || got != want {
+			t.Errorf("DocFreq(%q) = %d, %v, want %d", tri, got, err, want)
+		}
+	}
+	r.Close()
+
+	// Replace a and add c.
+	seg = &Segment{}
+	seg.Add(Doc{ID: "a", Path: "/src", Name: "a.go"}, []byte("farewell world"))
+	seg.Add(Doc{ID: "c", Path: "/other", Name: "c.go"}, []byte("hello again"))
+	if n := merge(t, path, seg, nil); n != 0 {
+		t.Errorf("replacing documents dropped %d documents", n)
+	}
+	tests = []struct {
+		re   string
+		want []string
+	}{
+		{"hello", []string{"c"}},
+		{"farewell", []string{"a"}},
+		{"world", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := query(t, path, tt.re); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.re, got, tt.want)
+		}
+	}
+
+	// Drop everything in /src.
+	n := merge(t, path, nil, func(doc Doc) bool { return doc.Path == "/src" })
+	if n != 2 {
+		t.Errorf("dropped %d documents, want 2", n)
+	}
+	if got := query(t, path, "world|hello"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("after dropping: got %q, want [c]", got)
+	}
+
+	r, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.NumDocs() != 1 {
+		t.Fatalf("got %d documents, want 1", r.NumDocs())
+	}
+	doc, err := r.Doc(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Doc{ID: "c", Path: "/other", Name: "c.go"}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("got %+v, want %+v", doc, want)
+	}
+}
+
+func TestIntersectUnion(t *testing.T) {
+	tests := []struct {
+		a, b         []uint32
+		inter, union []uint32
+	}{
+		{nil, nil, nil, []uint32{}},
+		{[]uint32{1, 2, 3}, nil, nil, []uint32{1, 2, 3}},
+		{[]uint32{1, 3, 5}, []uint32{2, 3, 4, 5}, []uint32{3, 5}, []uint32{1, 2, 3, 4, 5}},
+		{[]uint32{1, 2}, []uint32{3, 4}, nil, []uint32{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		if got := intersect(tt.a, tt.b); !reflect.DeepEqual(got, tt.inter) {
+			t.Errorf("intersect(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.inter)
+		}
+		if got := union(tt.a, tt.b); !reflect.DeepEqual(got, tt.union) {
+			t.Errorf("union(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.union)
+		}
+	}
+}
+
+func TestCorruptDoc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	seg := &Segment{}
+	seg.Add(Doc{ID: "a", Path: "/src", Name: "a.go"}, []byte("hello world"))
+	merge(t, path, seg, nil)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, err := r.uint64At(r.docIndexOff)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim that the document's ID is far longer than the file.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	_, err = f.WriteAt(buf[:binary.PutUvarint(buf[:], 1<<62)], int64(off))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Doc(0); err != ErrCorrupt {
+		t.Errorf("Doc(0) = %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,123 @@
+package regexp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+type jsonSpan struct {
+	Text  string `json:"text"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+type jsonSubmatch struct {
+	jsonSpan
+	// Capture groups, nil for groups that didn't participate in
+	// the match.
+	Groups []*jsonSpan `json:"groups,omitempty"`
+}
+
+type jsonLine struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// The path split into the file on disk and the files in
+	// archives leading up to the matching file.
+	Segments []string `json:"segments"`
+	Line     int      `json:"line_number"`
+	// The last line of a match that spans lines, for the Multiline
+	// flag.
+	EndLine    int            `json:"end_line_number,omitempty"`
+	Offset     int64          `json:"offset"`
+	Text       string         `json:"text"`
+	Submatches []jsonSubmatch `json:"submatches,omitempty"`
+}
+
+type jsonFile struct {
+	Type     string   `json:"type"`
+	Path     string   `json:"path"`
+	Segments []string `json:"segments"`
+	Matches  int      `json:"matches,omitempty"`
+}
+
+func (g *Grep) writeJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	g.Stdout.Write(append(b, '\n'))
+}
+
+func (g *Grep) printJSONLine(line []byte, lineno int, offset int64, match bool) {
+	text := bytes.TrimSuffix(line, nl)
+	v := jsonLine{
+		Type:     "context",
+		Path:     g.prefix,
+		Segments: strings.Split(g.name, "\x00"),
+		Line:     lineno,
+		Offset:   offset,
+		Text:     string(text),
+	}
+	if match {
+		v.Type = "match"
+		v.Submatches = jsonSubmatches(text, 0, g.Regexp.findAllSubmatch(text))
+	}
+	g.writeJSON(v)
+}
+
+// printJSONBlock prints the lines of a block, which start at line
+// number lineno, as a single match.
+func (g *Grep) printJSONBlock(text []byte, blk block, lineno int) {
+	v := jsonLine{
+		Type:       "match",
+		Path:       g.prefix,
+		Segments:   strings.Split(g.name, "\x00"),
+		Line:       lineno,
+		Offset:     int64(blk.start),
+		Text:       string(text),
+		Submatches: jsonSubmatches(text, blk.start, blk.matches),
+	}
+	if n := countNL(text); n > 0 {
+		v.EndLine = lineno + n
+	}
+	g.writeJSON(v)
+}
+
+// jsonSubmatches converts submatch offsets relative to text plus off.
+func jsonSubmatches(text []byte, off int, matches [][]int) []jsonSubmatch {
+	// A match may end with the newline that text lacks.
+	span := func(start, end int) jsonSpan {
+		start, end = start-off, end-off
+		if end > len(text) {
+			end = len(text)
+		}
+		if start > end {
+			start = end
+		}
+		return jsonSpan{string(text[start:end]), start, end}
+	}
+	var out []jsonSubmatch
+	for _, m := range matches {
+		sm := jsonSubmatch{jsonSpan: span(m[0], m[1])}
+		for i := 2; i < len(m); i += 2 {
+			if m[i] < 0 {
+				sm.Groups = append(sm.Groups, nil)
+				continue
+			}
+			sp := span(m[i], m[i+1])
+			sm.Groups = append(sm.Groups, &sp)
+		}
+		out = append(out, sm)
+	}
+	return out
+}
+
+func (g *Grep) printJSONFile() {
+	g.writeJSON(jsonFile{
+		Type:     "file",
+		Path:     g.prefix,
+		Segments: strings.Split(g.name, "\x00"),
+		Matches:  g.Matches,
+	})
+}
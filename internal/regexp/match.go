@@ -11,7 +11,10 @@ import (
 	"io"
 	"regexp/syntax"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"honnef.co/go/idxgrep/internal/sparse"
 )
@@ -23,12 +26,39 @@ type matcher struct {
 	start     *dstate            // start state
 	startLine *dstate            // start state for beginning of line
 	z1, z2    nstate             // two temporary nstates
+	runeWord  bool               // check word boundaries on whole runes
+
+	maxStates int   // maximum number of cached dstates
+	flushing  bool  // the cache is being flushed
+	scanned   int64 // bytes scanned by completed searches
+	flushedAt int64 // value of scanned plus progress at the last flush
+	stats     Stats
+}
+
+const (
+	// defaultMaxStates is the default size of the dstate cache.
+	// Each dstate takes up about 2 KiB.
+	defaultMaxStates = 4096
+
+	// minBytesPerState is the number of bytes that have to be
+	// scanned per cached dstate between flushes. If the cache is
+	// flushed more often, the DFA isn't worth its cost and the
+	// search continues by simulating the NFA.
+	minBytesPerState = 10
+)
+
+// Stats describes the work done by a Regexp's matcher.
+type Stats struct {
+	States       int // dstates currently cached
+	MaxStates    int // size limit of the cache
+	Flushes      int // times the cache was flushed because it was full
+	NFAFallbacks int // searches that continued by simulating the NFA
 }
 
 // An nstate corresponds to an NFA state.
 type nstate struct {
 	q       sparse.Set // queue of program instructions
-	partial rune       // partially decoded rune (TODO)
+	partial rune       // bytes of a partially read rune, first byte lowest
 	flag    flags      // flags (TODO)
 }
 
@@ -125,6 +155,15 @@ func init() {
 func (m *matcher) init(prog *syntax.Prog) error {
 	m.prog = prog
 	m.dstate = make(map[string]*dstate)
+	if m.maxStates == 0 {
+		m.maxStates = defaultMaxStates
+	}
+
+	for _, i := range prog.Inst {
+		if i.Op == syntax.InstEmptyWidth && syntax.EmptyOp(i.Arg)&(syntax.EmptyWordBoundary|syntax.EmptyNoWordBoundary) != 0 {
+			m.runeWord = true
+		}
+	}
 
 	m.z1.q.Init(uint32(len(prog.Inst)))
 	m.z2.q.Init(uint32(len(prog.Inst)))
@@ -205,25 +244,92 @@ const endText = -1
 
 // computeNext computes the next DFA state if we're in d reading c (an input byte or endText).
 func (m *matcher) computeNext(d *dstate, c int) *dstate {
-	this, next := &m.z1, &m.z2
-	this.dec(d.enc)
+	m.z1.dec(d.enc)
+	if m.step(&m.z1, &m.z2, c) {
+		return &dmatch
+	}
+	return m.cache(&m.z1)
+}
+
+// step advances the NFA state z by reading c (an input byte or
+// endText), using tmp as scratch space. It reports whether a match
+// ends immediately before c, in which case z is no longer meaningful.
+//
+// If the program has word boundaries, whether the position before a
+// multi-byte rune is a boundary depends on the whole rune. Its bytes
+// are kept in z.partial until it is complete, and then read at once.
+func (m *matcher) step(z, tmp *nstate, c int) bool {
+	var buf [utf8.UTFMax]int
+	if !m.runeWord {
+		buf[0] = c
+		return m.stepBytes(z, tmp, buf[:1], isWordByte(c))
+	}
+	bs := buf[:0]
+	for p := z.partial; p != 0; p >>= 8 {
+		bs = append(bs, int(p&0xff))
+	}
+	if len(bs) > 0 {
+		if 0x80 <= c && c < 0xc0 {
+			bs = append(bs, c)
+			if len(bs) < runeLen(bs[0]) {
+				z.partial |= rune(c) << (8 * uint(len(bs)-1))
+				return false
+			}
+			z.partial = 0
+			var rb [utf8.UTFMax]byte
+			for i, b := range bs {
+				rb[i] = byte(b)
+			}
+			r, _ := utf8.DecodeRune(rb[:len(bs)])
+			return m.stepBytes(z, tmp, bs, isWordRune(r))
+		}
+		// The rune is invalid and no word character.
+		z.partial = 0
+		if m.stepBytes(z, tmp, bs, false) {
+			return true
+		}
+	}
+	if 0xc0 <= c && c < 0xf8 {
+		z.partial = rune(c)
+		return false
+	}
+	return m.stepBytes(z, tmp, append(bs[:0], c), isWordByte(c))
+}
+
+// runeLen returns the length of the UTF-8 sequence starting with the
+// byte c, which must be at least 0xc0.
+func runeLen(c int) int {
+	switch {
+	case c < 0xe0:
+		return 2
+	case c < 0xf0:
+		return 3
+	}
+	return 4
+}
+
+// stepBytes advances z by reading bs, a single byte or endText, or
+// the bytes of one rune. word reports whether they form a word
+// character.
+func (m *matcher) stepBytes(z, tmp *nstate, bs []int, word bool) bool {
+	c := bs[0]
 
 	// compute flags in effect before c
 	flag := syntax.EmptyOp(0)
-	if this.flag&flagBOL != 0 {
+	if z.flag&flagBOL != 0 {
 		flag |= syntax.EmptyBeginLine
 	}
-	if this.flag&flagBOT != 0 {
+	if z.flag&flagBOT != 0 {
 		flag |= syntax.EmptyBeginText
 	}
-	if this.flag&flagWord != 0 {
-		if !isWordByte(c) {
+	if z.flag&flagWord != 0 {
+		if !word {
 			flag |= syntax.EmptyWordBoundary
 		} else {
 			flag |= syntax.EmptyNoWordBoundary
 		}
 	} else {
-		if isWordByte(c) {
+		if word {
 			flag |= syntax.EmptyWordBoundary
 		} else {
 			flag |= syntax.EmptyNoWordBoundary
@@ -239,33 +345,47 @@ func (m *matcher) computeNext(d *dstate, c int) *dstate {
 	// re-expand queue using new flags.
 	// TODO: only do this when it matters
 	// (something is gating on word boundaries).
-	m.stepEmpty(&this.q, &next.q, flag)
-	this, next = next, this
+	m.stepEmpty(&z.q, &tmp.q, flag)
 
-	// now compute flags after c.
-	flag = 0
-	next.flag = 0
-	if c == '\n' {
-		flag |= syntax.EmptyBeginLine
-		next.flag |= flagBOL
-	}
-	if isWordByte(c) {
-		next.flag |= flagWord
-	}
+	match := false
+	for i, c := range bs {
+		if i > 0 {
+			z.q, tmp.q = tmp.q, z.q
+		}
 
-	// re-add start, process rune + expand according to flags.
-	if m.stepByte(&this.q, &next.q, c, flag) {
-		return &dmatch
+		// now compute flags after c.
+		flag = 0
+		z.flag = 0
+		if c == '\n' {
+			flag |= syntax.EmptyBeginLine
+			z.flag |= flagBOL
+		}
+		if word && i == len(bs)-1 {
+			z.flag |= flagWord
+		}
+
+		// re-add start, process rune + expand according to flags.
+		if m.stepByte(&tmp.q, &z.q, c, flag) {
+			match = true
+		}
 	}
-	return m.cache(next)
+	return match
 }
 
 func (m *matcher) cache(z *nstate) *dstate {
-	enc := z.enc()
+	return m.cacheEnc(z.enc())
+}
+
+// cacheEnc returns the dstate for the encoded nstate enc, creating
+// it if necessary. If the cache is full, it is flushed first.
+func (m *matcher) cacheEnc(enc string) *dstate {
 	d := m.dstate[enc]
 	if d != nil {
 		return d
 	}
+	if len(m.dstate) >= m.maxStates && !m.flushing && m.startLine != nil {
+		m.flush()
+	}
 
 	d = &dstate{enc: enc}
 	m.dstate[enc] = d
@@ -274,6 +394,68 @@ func (m *matcher) cache(z *nstate) *dstate {
 	return d
 }
 
+// flush empties the dstate cache. States that are still referenced,
+// such as the one a search is in, stay valid, but are no longer
+// reachable from the new states.
+func (m *matcher) flush() {
+	m.flushing = true
+	defer func() { m.flushing = false }()
+	m.stats.Flushes++
+	start, startLine := m.start.enc, m.startLine.enc
+	m.dstate = make(map[string]*dstate)
+	m.start = m.cacheEnc(start)
+	m.startLine = m.cacheEnc(startLine)
+}
+
+// flushedTooOften reports whether the cache was flushed at position
+// pos, counted like flushedAt, after fewer than minBytesPerState
+// bytes per state since the previous flush.
+func (m *matcher) flushedTooOften(pos int64) bool {
+	tooOften := pos-m.flushedAt < int64(m.maxStates)*minBytesPerState
+	m.flushedAt = pos
+	return tooOften
+}
+
+// nfa continues a search in state d by simulating the NFA on b,
+// without building dstates. It returns the end of the first matching
+// line in b, like match.
+func (m *matcher) nfa(d *dstate, b []byte, eot bool) (end int) {
+	m.stats.NFAFallbacks++
+	z, tmp := &m.z1, &m.z2
+	if d == &dmatch {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return i
+		}
+		return len(b)
+	}
+	z.dec(d.enc)
+	for i, c := range b {
+		if c == '\n' {
+			if m.step(z, tmp, '\n') {
+				return i
+			}
+			z.dec(m.startLine.enc)
+			continue
+		}
+		if m.step(z, tmp, int(c)) {
+			// Like dmatch, wait for the end of the line.
+			if j := bytes.IndexByte(b[i:], '\n'); j >= 0 {
+				return i + j
+			}
+			return len(b)
+		}
+	}
+	enc := z.enc()
+	if m.step(z, tmp, '\n') {
+		return len(b)
+	}
+	z.dec(enc)
+	if eot && m.step(z, tmp, endText) {
+		return len(b)
+	}
+	return -1
+}
+
 func (m *matcher) match(b []byte, beginText, endText bool) (end int) {
 	//	fmt.Printf("%v\n", m.prog)
 
@@ -283,6 +465,7 @@ func (m *matcher) match(b []byte, beginText, endText bool) (end int) {
 	}
 	//	m.z1.dec(d.enc)
 	//	fmt.Printf("%v (%v)\n", &m.z1, d==&dmatch)
+	defer func() { m.scanned += int64(len(b)) }()
 	for i, c := range b {
 		d1 := d.next[c]
 		if d1 == nil {
@@ -292,7 +475,14 @@ func (m *matcher) match(b []byte, beginText, endText bool) (end int) {
 				}
 				d1 = m.startLine
 			} else {
+				flushes := m.stats.Flushes
 				d1 = m.computeNext(d, int(c))
+				if m.stats.Flushes != flushes && m.flushedTooOften(m.scanned+int64(i)) {
+					if end := m.nfa(d1, b[i+1:], endText); end >= 0 {
+						return i + 1 + end
+					}
+					return -1
+				}
 			}
 			d.next[c] = d1
 		}
@@ -311,6 +501,7 @@ func (m *matcher) matchString(b string, beginText, endText bool) (end int) {
 	if beginText {
 		d = m.start
 	}
+	defer func() { m.scanned += int64(len(b)) }()
 	for i := 0; i < len(b); i++ {
 		c := b[i]
 		d1 := d.next[c]
@@ -321,7 +512,14 @@ func (m *matcher) matchString(b string, beginText, endText bool) (end int) {
 				}
 				d1 = m.startLine
 			} else {
+				flushes := m.stats.Flushes
 				d1 = m.computeNext(d, int(c))
+				if m.stats.Flushes != flushes && m.flushedTooOften(m.scanned+int64(i)) {
+					if end := m.nfa(d1, []byte(b[i+1:]), endText); end >= 0 {
+						return i + 1 + end
+					}
+					return -1
+				}
 			}
 			d.next[c] = d1
 		}
@@ -333,11 +531,9 @@ func (m *matcher) matchString(b string, beginText, endText bool) (end int) {
 	return -1
 }
 
-// isWordByte reports whether the byte c is a word character: ASCII only.
-// This is used to implement \b and \B.  This is not right for Unicode, but:
-//	- it's hard to get right in a byte-at-a-time matching world
-//	  (the DFA has only one-byte lookahead)
-//	- this crude approximation is the same one PCRE uses
+// isWordByte reports whether the byte c is an ASCII word character.
+// This is used to implement \b and \B. Bytes of multi-byte runes are
+// never word characters on their own; see isWordRune.
 func isWordByte(c int) bool {
 	return 'A' <= c && c <= 'Z' ||
 		'a' <= c && c <= 'z' ||
@@ -345,21 +541,67 @@ func isWordByte(c int) bool {
 		c == '_'
 }
 
+// isWordRune reports whether r is a word character: a letter, mark,
+// decimal digit or connector punctuation.
+func isWordRune(r rune) bool {
+	if r < utf8.RuneSelf {
+		return isWordByte(int(r))
+	}
+	return unicode.In(r, unicode.L, unicode.M, unicode.Nd, unicode.Pc)
+}
+
 // TODO:
 type Grep struct {
 	Regexp *Regexp   // regexp to search for
 	Stdout io.Writer // output target
 	Stderr io.Writer // error target
 
-	L bool // L flag - print file names only
-	N bool // N flag - print line numbers
-	H bool // H flag - do not print file names
-
-	Match bool
+	L      bool // L flag - print file names only
+	N      bool // N flag - print line numbers
+	H      bool // H flag - do not print file names
+	V      bool // v flag - select non-matching lines
+	A      int  // A flag - print lines of trailing context
+	B      int  // B flag - print lines of leading context
+	O      bool // o flag - print only the matching parts of lines
+	Count  bool // c flag - print the number of matching lines only
+	Color  bool // highlight matches, file names and line numbers
+	Column bool // print the byte column of the first match, starting at 1
+	JSON   bool // print one JSON object per line and per file
+
+	// Multiline reads whole files and lets matches span lines. All
+	// lines of a match are selected.
+	Multiline bool
+
+	Match   bool
+	Matches int // number of selected lines
+	// Grouped is set once a group of context lines has been printed,
+	// for any file, unless printing JSON. The first group of a file is separated from the
+	// last group of the previous file if it is set.
+	Grouped bool
 
 	buf []byte
+
+	// per-file state
+	name    string
+	prefix  string
+	printed int       // number of the last printed line
+	after   int       // remaining lines of trailing context
+	before  []ctxLine // candidates for leading context
 }
 
+type ctxLine struct {
+	lineno int
+	offset int64
+	text   []byte
+}
+
+const (
+	colorName  = "35"
+	colorLine  = "32"
+	colorSep   = "36"
+	colorMatch = "01;31"
+)
+
 var nl = []byte{'\n'}
 
 func countNL(b []byte) int {
@@ -375,20 +617,230 @@ func countNL(b []byte) int {
 	return n
 }
 
+func (g *Grep) color(s string, color string) string {
+	if !g.Color {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[m"
+}
+
+func (g *Grep) context() bool {
+	return (g.A > 0 || g.B > 0) && (!g.O || g.JSON) && !g.Count
+}
+
+// appendPrefix appends the file name, line number and column, as
+// requested, to out. A column of 0 is omitted. sep is ':' for matching
+// lines and '-' for context lines.
+func (g *Grep) appendPrefix(out []byte, lineno int, col int, sep string) []byte {
+	if !g.H {
+		out = append(out, g.color(g.prefix, colorName)...)
+		out = append(out, g.color(sep, colorSep)...)
+	}
+	if g.N {
+		out = append(out, g.color(strconv.Itoa(lineno), colorLine)...)
+		out = append(out, g.color(sep, colorSep)...)
+	}
+	if g.Column && col > 0 {
+		out = append(out, g.color(strconv.Itoa(col), colorLine)...)
+		out = append(out, g.color(sep, colorSep)...)
+	}
+	return out
+}
+
+// printLine prints a single matching line, or a line of context.
+func (g *Grep) printLine(line []byte, lineno int, offset int64, sep string) {
+	g.printed = lineno
+	if g.JSON {
+		g.printJSONLine(line, lineno, offset, sep == ":")
+		return
+	}
+	text := bytes.TrimSuffix(line, nl)
+	var matches [][]int
+	if sep == ":" && (g.Color || g.Column) {
+		matches = g.Regexp.findAll(text)
+	}
+	col := 0
+	if len(matches) > 0 {
+		col = matches[0][0] + 1
+	}
+	out := g.appendPrefix(nil, lineno, col, sep)
+	out = g.appendText(out, text, 0, matches)
+	out = append(out, '\n')
+	g.Stdout.Write(out)
+}
+
+// appendText appends text to out, highlighting matches if requested.
+// The matches are offsets relative to text plus off, and are clipped
+// to text.
+func (g *Grep) appendText(out, text []byte, off int, matches [][]int) []byte {
+	if !g.Color {
+		return append(out, text...)
+	}
+	last := 0
+	for _, m := range matches {
+		start, end := m[0]-off, m[1]-off
+		if start < last {
+			start = last
+		}
+		if end > len(text) {
+			end = len(text)
+		}
+		if start >= end {
+			continue
+		}
+		out = append(out, text[last:start]...)
+		out = append(out, g.color(string(text[start:end]), colorMatch)...)
+		last = end
+	}
+	return append(out, text[last:]...)
+}
+
+// printMatches prints only the matching parts of a line, one per
+// output line.
+func (g *Grep) printMatches(line []byte, lineno int) {
+	text := bytes.TrimSuffix(line, nl)
+	for _, m := range g.Regexp.findAll(text) {
+		if m[0] == m[1] {
+			continue
+		}
+		out := g.appendPrefix(nil, lineno, m[0]+1, ":")
+		out = append(out, g.color(string(text[m[0]:m[1]]), colorMatch)...)
+		out = append(out, '\n')
+		g.Stdout.Write(out)
+	}
+}
+
+// printFile prints the name of a file that contains matches, for the
+// L and c flags.
+func (g *Grep) printFile() {
+	if g.JSON {
+		g.printJSONFile()
+		return
+	}
+	if g.L {
+		fmt.Fprintf(g.Stdout, "%s\n", g.name)
+		return
+	}
+	var out []byte
+	if !g.H {
+		out = append(out, g.color(g.prefix, colorName)...)
+		out = append(out, g.color(":", colorSep)...)
+	}
+	out = strconv.AppendInt(out, int64(g.Matches), 10)
+	out = append(out, '\n')
+	g.Stdout.Write(out)
+}
+
+// skipped processes lines that didn't match, printing them as
+// trailing context or remembering them as leading context.
+func (g *Grep) skipped(b []byte, lineno int, offset int64) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		line := b[:i]
+		b = b[i:]
+		if g.after > 0 {
+			g.printLine(line, lineno, offset, "-")
+			g.after--
+		} else if g.B > 0 {
+			if len(g.before) == g.B {
+				copy(g.before, g.before[1:])
+				g.before = g.before[:len(g.before)-1]
+			}
+			g.before = append(g.before, ctxLine{lineno, offset, append([]byte(nil), line...)})
+		}
+		lineno++
+		offset += int64(i)
+	}
+}
+
+// selected processes lines that didn't match when inverting the
+// selection. It reports whether the rest of the input can be skipped.
+func (g *Grep) selected(b []byte, lineno int, offset int64) bool {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		g.Match = true
+		if g.L {
+			g.printFile()
+			return true
+		}
+		g.matched(b[:i], lineno, offset)
+		b = b[i:]
+		lineno++
+		offset += int64(i)
+	}
+	return false
+}
+
+// PrintSeparator prints the separator between groups of context
+// lines.
+func (g *Grep) PrintSeparator() {
+	fmt.Fprintln(g.Stdout, g.color("--", colorSep))
+}
+
+// startGroup starts a group of context lines at line number first,
+// printing a separator if the group doesn't directly follow the
+// previous one, which may belong to an earlier file.
+func (g *Grep) startGroup(first int) {
+	if g.JSON {
+		return
+	}
+	if g.printed > 0 && first > g.printed+1 || g.printed == 0 && g.Grouped {
+		g.PrintSeparator()
+	}
+	g.Grouped = true
+}
+
+// matched processes a selected line.
+func (g *Grep) matched(line []byte, lineno int, offset int64) {
+	g.Matches++
+	switch {
+	case g.Count:
+	case g.O && !g.JSON:
+		g.printMatches(line, lineno)
+	case g.context():
+		first := lineno
+		if len(g.before) > 0 {
+			first = g.before[0].lineno
+		}
+		g.startGroup(first)
+		for _, l := range g.before {
+			g.printLine(l.text, l.lineno, l.offset, "-")
+		}
+		g.before = g.before[:0]
+		g.printLine(line, lineno, offset, ":")
+		g.after = g.A
+	default:
+		g.printLine(line, lineno, offset, ":")
+	}
+}
+
 func (g *Grep) Reader(r io.Reader, name string) {
 	if g.buf == nil {
 		g.buf = make([]byte, 1<<20)
 	}
 	var (
 		buf        = g.buf[:0]
-		needLineno = g.N
+		needLineno = g.N || g.context() || g.V || g.JSON
 		lineno     = 1
-		prefix     = ""
+		base       int64 // offset of buf in the input
 		beginText  = true
 		endText    = false
 	)
-	if !g.H {
-		prefix = strings.Replace(name, "\x00", " -> ", -1) + ":"
+	g.name = name
+	g.prefix = strings.Replace(name, "\x00", " -> ", -1)
+	g.Matches = 0
+	g.printed = 0
+	g.after = 0
+	g.before = g.before[:0]
+	if g.Multiline {
+		g.readerMultiline(r)
+		return
 	}
 	for {
 		if len(buf) == cap(buf) {
@@ -411,36 +863,51 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			if m1 < chunkStart {
 				break
 			}
-			g.Match = true
-			if g.L {
-				fmt.Fprintf(g.Stdout, "%s\n", name)
-				return
-			}
 			lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
 			lineEnd := m1 + 1
 			if lineEnd > end {
 				lineEnd = end
 			}
+			if g.V {
+				if g.selected(buf[chunkStart:lineStart], lineno, base+int64(chunkStart)) {
+					return
+				}
+			} else if g.context() {
+				g.skipped(buf[chunkStart:lineStart], lineno, base+int64(chunkStart))
+			}
 			if needLineno {
 				lineno += countNL(buf[chunkStart:lineStart])
 			}
-			line := buf[lineStart:lineEnd]
-			switch {
-			case g.N:
-				fmt.Fprintf(g.Stdout, "%s%d:%s", prefix, lineno, line)
-			default:
-				fmt.Fprintf(g.Stdout, "%s%s", prefix, line)
+			if g.V {
+				if g.context() {
+					g.skipped(buf[lineStart:lineEnd], lineno, base+int64(lineStart))
+				}
+			} else {
+				g.Match = true
+				if g.L {
+					g.printFile()
+					return
+				}
+				g.matched(buf[lineStart:lineEnd], lineno, base+int64(lineStart))
 			}
 			if needLineno {
 				lineno++
 			}
 			chunkStart = lineEnd
 		}
+		if g.V {
+			if g.selected(buf[chunkStart:end], lineno, base+int64(chunkStart)) {
+				return
+			}
+		} else if g.context() {
+			g.skipped(buf[chunkStart:end], lineno, base+int64(chunkStart))
+		}
 		if needLineno && err == nil {
 			lineno += countNL(buf[chunkStart:end])
 		}
 		n = copy(buf, buf[end:])
 		buf = buf[:n]
+		base += int64(end)
 		if len(buf) == 0 && err != nil {
 			if err != io.EOF && err != io.ErrUnexpectedEOF {
 				fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
@@ -448,4 +915,7 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			break
 		}
 	}
+	if g.Matches > 0 && (g.Count || g.JSON) {
+		g.printFile()
+	}
 }
@@ -0,0 +1,163 @@
+package regexp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// A block is a run of whole lines that contains one or more matches,
+// for the Multiline flag.
+type block struct {
+	start, end int     // offsets of the lines in the text
+	matches    [][]int // submatch offsets relative to the text
+}
+
+// blocks returns the blocks of lines that contain the matches of the
+// regexp in b. Blocks of overlapping matches are merged.
+func (g *Grep) blocks(b []byte) []block {
+	var out []block
+	for _, m := range g.Regexp.findAllText(b) {
+		if m[0] == len(b) && m[0] > 0 && b[m[0]-1] == '\n' {
+			// An empty match after the final newline isn't
+			// on any line.
+			continue
+		}
+		start := bytes.LastIndexByte(b[:m[0]], '\n') + 1
+		last := m[0]
+		if m[1] > m[0] {
+			last = m[1] - 1
+		}
+		end := len(b)
+		if i := bytes.IndexByte(b[last:], '\n'); i >= 0 {
+			end = last + i + 1
+		}
+		if n := len(out); n > 0 && start < out[n-1].end {
+			if end > out[n-1].end {
+				out[n-1].end = end
+			}
+			out[n-1].matches = append(out[n-1].matches, m)
+			continue
+		}
+		out = append(out, block{start, end, [][]int{m}})
+	}
+	return out
+}
+
+// readerMultiline implements Reader for the Multiline flag. It reads
+// all of r and selects the lines that matches span.
+func (g *Grep) readerMultiline(r io.Reader) {
+	buf := bytes.NewBuffer(g.buf[:0])
+	_, err := buf.ReadFrom(r)
+	b := buf.Bytes()
+	g.buf = b[:0]
+	if err != nil {
+		fmt.Fprintf(g.Stderr, "%s: %v\n", g.name, err)
+	}
+
+	lineno, pos := 1, 0
+	for _, blk := range g.blocks(b) {
+		if g.V {
+			if g.selected(b[pos:blk.start], lineno, int64(pos)) {
+				return
+			}
+		} else if g.context() {
+			g.skipped(b[pos:blk.start], lineno, int64(pos))
+		}
+		lineno += countNL(b[pos:blk.start])
+		text := b[blk.start:blk.end]
+		if g.V {
+			if g.context() {
+				g.skipped(text, lineno, int64(blk.start))
+			}
+		} else {
+			g.Match = true
+			if g.L {
+				g.printFile()
+				return
+			}
+			g.matchedBlock(text, blk, lineno)
+		}
+		lineno += countNL(text)
+		pos = blk.end
+	}
+	if g.V {
+		if g.selected(b[pos:], lineno, int64(pos)) {
+			return
+		}
+	} else if g.context() {
+		g.skipped(b[pos:], lineno, int64(pos))
+	}
+	if g.Matches > 0 && (g.Count || g.JSON) {
+		g.printFile()
+	}
+}
+
+// matchedBlock processes the lines of a block, which start at line
+// number lineno.
+func (g *Grep) matchedBlock(lines []byte, blk block, lineno int) {
+	text := bytes.TrimSuffix(lines, nl)
+	g.Matches += countNL(text) + 1
+	switch {
+	case g.Count:
+	case g.O && !g.JSON:
+		for _, m := range blk.matches {
+			if m[0] == m[1] {
+				continue
+			}
+			start := m[0] - blk.start
+			out := g.appendPrefix(nil, lineno+countNL(text[:start]), start-bytes.LastIndexByte(text[:start], '\n'), ":")
+			out = g.appendText(out, lines[start:m[1]-blk.start], m[0], [][]int{m})
+			out = append(out, '\n')
+			g.Stdout.Write(out)
+		}
+	case g.context():
+		first := lineno
+		if len(g.before) > 0 {
+			first = g.before[0].lineno
+		}
+		g.startGroup(first)
+		for _, l := range g.before {
+			g.printLine(l.text, l.lineno, l.offset, "-")
+		}
+		g.before = g.before[:0]
+		g.printBlock(text, blk, lineno)
+		g.after = g.A
+	default:
+		g.printBlock(text, blk, lineno)
+	}
+}
+
+// printBlock prints the lines of a block, without its final newline.
+// In JSON, the block is a single object.
+func (g *Grep) printBlock(text []byte, blk block, lineno int) {
+	g.printed = lineno + countNL(text)
+	if g.JSON {
+		g.printJSONBlock(text, blk, lineno)
+		return
+	}
+	// Offsets of matches are relative to the whole text, those of
+	// lines relative to the block.
+	off := blk.start
+	for first := true; ; first = false {
+		line := text
+		i := bytes.IndexByte(text, '\n')
+		if i >= 0 {
+			line = text[:i]
+		}
+		col := 0
+		if first {
+			col = blk.matches[0][0] - blk.start + 1
+		}
+		out := g.appendPrefix(nil, lineno, col, ":")
+		out = g.appendText(out, line, off, blk.matches)
+		out = append(out, '\n')
+		g.Stdout.Write(out)
+		if i < 0 {
+			break
+		}
+		text = text[i+1:]
+		off += i + 1
+		lineno++
+	}
+}
@@ -0,0 +1,260 @@
+package regexp
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// A pike locates matches by simulating the NFA on runes while
+// tracking capture groups, like the standard library does. Unlike the
+// standard library, it checks word boundaries on Unicode word
+// characters, agreeing with the DFA. It is only used for regexps
+// that contain \b or \B.
+type pike struct {
+	prog     *syntax.Prog
+	q0, q1   pikeQueue
+	pool     []*pikeThread
+	matched  bool
+	matchcap []int
+}
+
+type pikeThread struct {
+	cap []int
+}
+
+type pikeEntry struct {
+	pc uint32
+	t  *pikeThread
+}
+
+// A pikeQueue is a sparse set of instructions, in priority order.
+type pikeQueue struct {
+	sparse []uint32
+	dense  []pikeEntry
+}
+
+func newPike(prog *syntax.Prog) *pike {
+	n := len(prog.Inst)
+	return &pike{
+		prog:     prog,
+		q0:       pikeQueue{make([]uint32, n), make([]pikeEntry, 0, n)},
+		q1:       pikeQueue{make([]uint32, n), make([]pikeEntry, 0, n)},
+		matchcap: make([]int, prog.NumCap),
+	}
+}
+
+func (q *pikeQueue) has(pc uint32) bool {
+	j := q.sparse[pc]
+	return j < uint32(len(q.dense)) && q.dense[j].pc == pc
+}
+
+func (p *pike) alloc() *pikeThread {
+	if n := len(p.pool); n > 0 {
+		t := p.pool[n-1]
+		p.pool = p.pool[:n-1]
+		return t
+	}
+	return &pikeThread{cap: make([]int, p.prog.NumCap)}
+}
+
+func (p *pike) clear(q *pikeQueue) {
+	for _, d := range q.dense {
+		if d.t != nil {
+			p.pool = append(p.pool, d.t)
+		}
+	}
+	q.dense = q.dense[:0]
+}
+
+// match returns the submatch locations of the leftmost match in b
+// that starts at or after pos, or nil.
+func (p *pike) match(b []byte, pos int) []int {
+	for i := range p.matchcap {
+		p.matchcap[i] = -1
+	}
+	p.matched = false
+	runq, nextq := &p.q0, &p.q1
+
+	r1 := rune(endText)
+	if pos > 0 {
+		r1, _ = utf8.DecodeLastRune(b[:pos])
+	}
+	r, width := rune(endText), 0
+	if pos < len(b) {
+		r, width = utf8.DecodeRune(b[pos:])
+	}
+	for {
+		if len(runq.dense) == 0 && p.matched {
+			break
+		}
+		if !p.matched {
+			p.matchcap[0] = pos
+			p.add(runq, uint32(p.prog.Start), pos, p.matchcap, emptyOpContext(r1, r), nil)
+		}
+		r2, width2 := rune(endText), 0
+		if width > 0 && pos+width < len(b) {
+			r2, width2 = utf8.DecodeRune(b[pos+width:])
+		}
+		p.step(runq, nextq, pos, pos+width, r, emptyOpContext(r, r2))
+		if width == 0 {
+			break
+		}
+		pos += width
+		r1, r, width = r, r2, width2
+		runq, nextq = nextq, runq
+	}
+	p.clear(runq)
+	p.clear(nextq)
+	if !p.matched {
+		return nil
+	}
+	return append([]int(nil), p.matchcap...)
+}
+
+// findAll returns the submatch locations of all matches in b, like
+// the standard library's FindAllSubmatchIndex.
+func (p *pike) findAll(b []byte) [][]int {
+	var out [][]int
+	for pos, prevEnd := 0, -1; pos <= len(b); {
+		m := p.match(b, pos)
+		if m == nil {
+			break
+		}
+		accept := true
+		if m[1] == m[0] {
+			// No empty match right after a previous match.
+			if m[0] == prevEnd {
+				accept = false
+			}
+			if m[1] < len(b) {
+				_, width := utf8.DecodeRune(b[m[1]:])
+				pos = m[1] + width
+			} else {
+				pos = len(b) + 1
+			}
+		} else {
+			pos = m[1]
+		}
+		prevEnd = m[1]
+		if accept {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// step runs the threads in runq on the rune c at pos, adding the
+// threads that consume it to nextq.
+func (p *pike) step(runq, nextq *pikeQueue, pos, nextPos int, c rune, nextCond syntax.EmptyOp) {
+	for j := 0; j < len(runq.dense); j++ {
+		d := &runq.dense[j]
+		t := d.t
+		if t == nil {
+			continue
+		}
+		i := &p.prog.Inst[d.pc]
+		add := false
+		switch i.Op {
+		case syntax.InstMatch:
+			t.cap[1] = pos
+			copy(p.matchcap, t.cap)
+			// Leftmost-first: cut off all lower-priority threads.
+			for _, d := range runq.dense[j+1:] {
+				if d.t != nil {
+					p.pool = append(p.pool, d.t)
+				}
+			}
+			runq.dense = runq.dense[:0]
+			p.matched = true
+		case syntax.InstRune:
+			add = i.MatchRune(c)
+		case syntax.InstRune1:
+			add = c == i.Rune[0]
+		case syntax.InstRuneAny:
+			add = true
+		case syntax.InstRuneAnyNotNL:
+			add = c != '\n'
+		}
+		if add {
+			t = p.add(nextq, i.Out, nextPos, t.cap, nextCond, t)
+		}
+		if t != nil {
+			p.pool = append(p.pool, t)
+		}
+	}
+	runq.dense = runq.dense[:0]
+}
+
+// add adds the thread at pc to q, following empty-width instructions
+// allowed by cond. It returns t if t wasn't used.
+func (p *pike) add(q *pikeQueue, pc uint32, pos int, cap []int, cond syntax.EmptyOp, t *pikeThread) *pikeThread {
+	if pc == 0 || q.has(pc) {
+		return t
+	}
+	j := len(q.dense)
+	q.dense = q.dense[:j+1]
+	d := &q.dense[j]
+	d.pc = pc
+	d.t = nil
+	q.sparse[pc] = uint32(j)
+
+	i := &p.prog.Inst[pc]
+	switch i.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		t = p.add(q, i.Out, pos, cap, cond, t)
+		t = p.add(q, i.Arg, pos, cap, cond, t)
+	case syntax.InstEmptyWidth:
+		if syntax.EmptyOp(i.Arg)&^cond == 0 {
+			t = p.add(q, i.Out, pos, cap, cond, t)
+		}
+	case syntax.InstNop:
+		t = p.add(q, i.Out, pos, cap, cond, t)
+	case syntax.InstCapture:
+		if int(i.Arg) < len(cap) {
+			opos := cap[i.Arg]
+			cap[i.Arg] = pos
+			p.add(q, i.Out, pos, cap, cond, nil)
+			cap[i.Arg] = opos
+		} else {
+			t = p.add(q, i.Out, pos, cap, cond, t)
+		}
+	case syntax.InstMatch, syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+		if t == nil {
+			t = p.alloc()
+		}
+		if &t.cap[0] != &cap[0] {
+			copy(t.cap, cap)
+		}
+		d.t = t
+		t = nil
+	}
+	return t
+}
+
+// emptyOpContext returns the empty-width conditions satisfied between
+// the runes r1 and r2, where endText stands for the beginning or end
+// of the text. Word boundaries use isWordRune.
+func emptyOpContext(r1, r2 rune) syntax.EmptyOp {
+	op := syntax.EmptyNoWordBoundary
+	boundary := false
+	switch {
+	case isWordRune(r1):
+		boundary = true
+	case r1 == '\n':
+		op |= syntax.EmptyBeginLine
+	case r1 == endText:
+		op |= syntax.EmptyBeginText | syntax.EmptyBeginLine
+	}
+	switch {
+	case isWordRune(r2):
+		boundary = !boundary
+	case r2 == '\n':
+		op |= syntax.EmptyEndLine
+	case r2 == endText:
+		op |= syntax.EmptyEndText | syntax.EmptyEndLine
+	}
+	if boundary {
+		op ^= syntax.EmptyWordBoundary | syntax.EmptyNoWordBoundary
+	}
+	return op
+}
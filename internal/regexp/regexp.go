@@ -6,7 +6,11 @@
 // use in grep-like programs.
 package regexp
 
-import "regexp/syntax"
+import (
+	"bytes"
+	stdregexp "regexp"
+	"regexp/syntax"
+)
 
 func bug() {
 	panic("codesearch/regexp: internal error")
@@ -18,6 +22,14 @@ type Regexp struct {
 	Syntax *syntax.Regexp
 	expr   string // original expression
 	m      matcher
+
+	// The DFA only finds the ends of matching lines. The standard
+	// library's implementation is used to locate matches within
+	// those lines.
+	std *stdregexp.Regexp
+	// The standard library's \b and \B only know ASCII word
+	// characters. If the regexp uses them, uni is used instead.
+	uni *pike
 }
 
 // String returns the source text used to compile the regular expression.
@@ -40,20 +52,149 @@ func Compile(expr string) (*Regexp, error) {
 	if err := toByteProg(prog); err != nil {
 		return nil, err
 	}
+	std, err := stdregexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
 	r := &Regexp{
 		Syntax: re,
 		expr:   expr,
+		std:    std,
 	}
 	if err := r.m.init(prog); err != nil {
 		return nil, err
 	}
+	if r.m.runeWord {
+		// toByteProg rewrote prog; the pike runs on runes.
+		prog, err := syntax.Compile(sre)
+		if err != nil {
+			return nil, err
+		}
+		r.uni = newPike(prog)
+	}
 	return r, nil
 }
 
+// Match returns the end of the first line in b that contains a
+// match, that is the offset of its newline or len(b), or -1 if there
+// is no match. beginText and endText report whether b begins and ends
+// the text.
 func (r *Regexp) Match(b []byte, beginText, endText bool) (end int) {
 	return r.m.match(b, beginText, endText)
 }
 
+// FindIndex returns the start and end of the leftmost match in b, or
+// nil if there is no match. The DFA finds the first matching line;
+// the match within that line is located using the standard library.
+func (r *Regexp) FindIndex(b []byte, beginText, endText bool) []int {
+	return r.find(b, beginText, endText, func(line []byte) []int {
+		if m := r.findSubmatch(line); m != nil {
+			return m[:2]
+		}
+		return nil
+	})
+}
+
+// FindSubmatchIndex is like FindIndex but also returns the start and
+// end of each capture group, in the format of the standard library's
+// Regexp.FindSubmatchIndex. Groups that don't participate in the
+// match have a start and end of -1.
+func (r *Regexp) FindSubmatchIndex(b []byte, beginText, endText bool) []int {
+	return r.find(b, beginText, endText, r.findSubmatch)
+}
+
+// NumSubexp returns the number of capture groups in the regexp.
+func (r *Regexp) NumSubexp() int {
+	return r.std.NumSubexp()
+}
+
+// find runs the DFA to find a matching line and fn to locate the
+// match within it.
+func (r *Regexp) find(b []byte, beginText, endText bool, fn func([]byte) []int) []int {
+	start := 0
+	for start <= len(b) {
+		end := r.Match(b[start:], beginText && start == 0, endText)
+		if end < 0 {
+			return nil
+		}
+		end += start
+		lineStart := bytes.LastIndexByte(b[start:end], '\n') + 1 + start
+		if m := fn(b[lineStart:end]); m != nil {
+			for i := range m {
+				if m[i] >= 0 {
+					m[i] += lineStart
+				}
+			}
+			return m
+		}
+		// The two implementations disagree in corner cases, such
+		// as invalid UTF-8. Continue with the next line.
+		start = end + 1
+	}
+	return nil
+}
+
 func (r *Regexp) MatchString(s string, beginText, endText bool) (end int) {
 	return r.m.matchString(s, beginText, endText)
 }
+
+// SetMaxStates limits the number of DFA states that r caches to n,
+// which is raised to 3 if it is smaller. When the cache is full, it
+// is flushed; if that happens too often, searches fall back to the
+// slower but memory-bounded NFA simulation.
+func (r *Regexp) SetMaxStates(n int) {
+	if n < 3 {
+		n = 3
+	}
+	r.m.maxStates = n
+}
+
+// Stats returns statistics about r's DFA cache.
+func (r *Regexp) Stats() Stats {
+	st := r.m.stats
+	st.States = len(r.m.dstate)
+	st.MaxStates = r.m.maxStates
+	return st
+}
+
+// MatchText reports whether b contains a match. Unlike Match, the
+// match may span lines.
+func (r *Regexp) MatchText(b []byte) bool {
+	if r.uni != nil {
+		return r.uni.match(b, 0) != nil
+	}
+	return r.std.Match(b)
+}
+
+// findSubmatch returns the submatch locations of the leftmost match
+// in b, or nil.
+func (r *Regexp) findSubmatch(b []byte) []int {
+	if r.uni != nil {
+		return r.uni.match(b, 0)
+	}
+	return r.std.FindSubmatchIndex(b)
+}
+
+// findAllText returns the submatch locations of all matches in b,
+// which may span lines.
+func (r *Regexp) findAllText(b []byte) [][]int {
+	return r.findAllSubmatch(b)
+}
+
+// findAll returns the locations of all matches in line, which must
+// be a single line of text without its trailing newline.
+func (r *Regexp) findAll(line []byte) [][]int {
+	if r.uni != nil {
+		return r.uni.findAll(line)
+	}
+	return r.std.FindAllIndex(line, -1)
+}
+
+// findAllSubmatch is like findAll but also returns the locations of
+// capture groups.
+func (r *Regexp) findAllSubmatch(line []byte) [][]int {
+	if r.uni != nil {
+		return r.uni.findAll(line)
+	}
+	return r.std.FindAllSubmatchIndex(line, -1)
+}
@@ -7,8 +7,11 @@ package regexp
 import (
 	"bytes"
 	"reflect"
+	"regexp"
+	"regexp/syntax"
 	"strings"
 	"testing"
+	"unicode"
 )
 
 var nstateTests = []struct {
@@ -117,6 +120,15 @@ var matchTests = []struct {
 	{`\B`, "xx", []int{1}},
 	{`\B`, "x y", nil},
 	{`\B`, "xx yy", []int{1}},
+	{`\bcafé\b`, "un café noir\ncaféine\n", []int{1}},
+	{`\bnoir`, "énoir\nnoir\n", []int{2}},
+	{`\Bnoir`, "énoir\nnoir\n", []int{1}},
+	{`日本\b`, "日本語\n日本 語\n", []int{2}},
+	{`\bx`, "\xffx\n", []int{1}},
+	{`a\b`, "a\xc3", []int{1}},
+	{`(?i)\bσοφία\b`, "ΣΟΦΊΑ\n", []int{1}},
+	{`(?i)𞤀`, "𞤢", []int{1}},
+	{`(?i)k`, "\u212a", []int{1}},
 	{`(?im)^[abc]+$`, "abcABC", []int{1}},
 	{`(?im)^[α]+$`, "αΑ", []int{1}},
 	{`[Aa]BC`, "abc", nil},
@@ -188,6 +200,44 @@ func grep(re *Regexp, b []byte) []int {
 	return m
 }
 
+var findTests = []struct {
+	re string
+	s  string
+	m  []int
+}{
+	{`b+`, "abbc", []int{1, 3}},
+	{`x`, "abc\ndef\n", nil},
+	{`e(f)?`, "abc\ndef\nghe\n", []int{5, 7, 6, 7}},
+	{`(a)|(g)h`, "bcd\nxgh\n", []int{5, 7, -1, -1, 5, 6}},
+	{`^d`, "abc\ndef", []int{4, 5}},
+	{`\bnoir\b`, "énoir noir", []int{7, 11}},
+	{`(\w+)\b`, "élan", []int{2, 5, 2, 5}},
+	{`\b(\w+)`, "élan lu", []int{6, 8, 6, 8}},
+	{`c$`, "abc\ndef", []int{2, 3}},
+	{`\bde`, "abcde\nde", []int{6, 8}},
+}
+
+func TestFind(t *testing.T) {
+	for _, tt := range findTests {
+		re, err := Compile("(?m)" + tt.re)
+		if err != nil {
+			t.Errorf("Compile(%#q): %v", tt.re, err)
+			continue
+		}
+		b := []byte(tt.s)
+		var want []int
+		if tt.m != nil {
+			want = tt.m[:2]
+		}
+		if m := re.FindIndex(b, true, true); !reflect.DeepEqual(m, want) {
+			t.Errorf("FindIndex(%#q, %q) = %v, want %v", tt.re, tt.s, m, want)
+		}
+		if m := re.FindSubmatchIndex(b, true, true); !reflect.DeepEqual(m, tt.m) {
+			t.Errorf("FindSubmatchIndex(%#q, %q) = %v, want %v", tt.re, tt.s, m, tt.m)
+		}
+	}
+}
+
 var grepTests = []struct {
 	re  string
 	s   string
@@ -197,6 +247,35 @@ var grepTests = []struct {
 }{
 	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:abc\ninput:ghalloo\n"},
 	{re: `x.*y`, s: "xay\nxa\ny\n", out: "input:xay\n"},
+	{re: `b`, s: "abc", out: "input:abc\n"},
+	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:2\n", g: Grep{Count: true}},
+	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "2\n", g: Grep{Count: true, H: true}},
+	{re: `x`, s: "abc\n", out: "", g: Grep{Count: true}},
+	{re: `al+|b`, s: "abc\ndef\nghalloo ball\n", out: "input:1:b\ninput:3:all\ninput:3:b\ninput:3:all\n", g: Grep{O: true, N: true}},
+	{re: `x`, s: "1\n2\nx3\n4\n5\n6\n7\nx8\n9\n", out: "input-2-2\ninput:3:x3\ninput-4-4\n--\ninput-7-7\ninput:8:x8\ninput-9-9\n", g: Grep{A: 1, B: 1, N: true}},
+	{re: `x`, s: "x1\n2\nx3\n4\n", out: "input:x1\ninput-2\ninput:x3\ninput-4\n", g: Grep{A: 1, B: 1}},
+	{re: `x`, s: "1\n2\n3\nx4\n", out: "input-2\ninput-3\ninput:x4\n", g: Grep{B: 2}},
+	{re: `a`, s: "abc\ndef\nghalloo\nxyz", out: "input:2:def\ninput:4:xyz\n", g: Grep{V: true, N: true}},
+	{re: `a`, s: "abc\ndef\n", out: "input:1\n", g: Grep{V: true, Count: true}},
+	{re: `a`, s: "abc\nabc\n", out: "", g: Grep{V: true, L: true}},
+	{re: `a`, s: "1\na\na\na\n2\n", out: "input:1\ninput-a\n--\ninput-a\ninput:2\n", g: Grep{V: true, A: 1, B: 1}},
+	{re: `(b)(x)?`, s: "d\nabc\n", out: `{"type":"match","path":"input","segments":["input"],"line_number":2,"offset":2,"text":"abc","submatches":[{"text":"b","start":1,"end":2,"groups":[{"text":"b","start":1,"end":2},null]}]}` + "\n" +
+		`{"type":"file","path":"input","segments":["input"],"matches":1}` + "\n", g: Grep{JSON: true}},
+	{re: `b`, s: "abc\n", out: "\x1b[35minput\x1b[m\x1b[36m:\x1b[ma\x1b[01;31mb\x1b[mc\n", g: Grep{Color: true}},
+	{re: `c+`, s: "abc\nccx\n", out: "input:1:3:abc\ninput:2:1:ccx\n", g: Grep{N: true, Column: true}},
+	{re: `b`, s: "abcb\n", out: "input:2:b\ninput:4:b\n", g: Grep{O: true, Column: true}},
+	{re: `a`, s: "abc\ndef\n", out: "input:def\n", g: Grep{V: true, Column: true}},
+	{re: `\bné\b`, s: "néant né\n", out: "input:1:8:né\n", g: Grep{N: true, O: true, Column: true}},
+	{re: `c\nd`, s: "abc\ndef\n", out: ""},
+	{re: `c\nd`, s: "x\nabc\ndef\ny\n", out: "input:2:abc\ninput:3:def\n", g: Grep{N: true, Multiline: true}},
+	{re: `c\s+d|y`, s: "abc\n\ndef\nxy", out: "input:1:3:abc\ninput:2:\ninput:3:def\ninput:4:2:xy\n", g: Grep{N: true, Column: true, Multiline: true}},
+	{re: `c\nd`, s: "abc\ndef\n", out: "input:1:3:c\nd\n", g: Grep{N: true, O: true, Column: true, Multiline: true}},
+	{re: `c\nd`, s: "abc\ndef\nghi\n", out: "input:2\n", g: Grep{Count: true, Multiline: true}},
+	{re: `c\nd`, s: "abc\ndef\nghi\n", out: "input:ghi\n", g: Grep{V: true, Multiline: true}},
+	{re: `c\nd|e`, s: "1\nabc\ndef\n2\n", out: "input-1\ninput:abc\ninput:def\ninput-2\n", g: Grep{A: 1, B: 1, Multiline: true}},
+	{re: `c\nd`, s: "abc\ndef\n", out: "ab\x1b[01;31mc\x1b[m\n\x1b[01;31md\x1b[mef\n", g: Grep{H: true, Color: true, Multiline: true}},
+	{re: `(c)\nd`, s: "abc\ndef\n", out: `{"type":"match","path":"input","segments":["input"],"line_number":1,"end_line_number":2,"offset":0,"text":"abc\ndef","submatches":[{"text":"c\nd","start":2,"end":5,"groups":[{"text":"c","start":2,"end":3}]}]}` + "\n" +
+		`{"type":"file","path":"input","segments":["input"],"matches":2}` + "\n", g: Grep{JSON: true, Multiline: true}},
 }
 
 func TestGrep(t *testing.T) {
@@ -217,3 +296,147 @@ func TestGrep(t *testing.T) {
 		}
 	}
 }
+
+func TestGrepFiles(t *testing.T) {
+	// Groups of context are separated across files too.
+	for _, multiline := range []bool{false, true} {
+		re, err := Compile("(?m)x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		g := Grep{Regexp: re, Stdout: &out, A: 1, Multiline: multiline}
+		g.Reader(strings.NewReader("1\nx2\n3\n"), "a")
+		g.Reader(strings.NewReader("none\n"), "b")
+		g.Reader(strings.NewReader("x1\n2\n"), "c")
+		want := "a:x2\na-3\n--\nc:x1\nc-2\n"
+		if out.String() != want {
+			t.Errorf("multiline %t: got %q, want %q", multiline, out.String(), want)
+		}
+	}
+}
+
+// pathological returns text on which `(a|b)*a.{n}` needs a new DFA
+// state for nearly every byte.
+func pathological(size int) []byte {
+	b := make([]byte, size)
+	x := uint32(1)
+	for i := range b {
+		x = x*1103515245 + 12345
+		b[i] = "ab"[x>>16&1]
+		if x>>17%97 == 0 {
+			b[i] = '\n'
+		}
+	}
+	return b
+}
+
+func TestMaxStates(t *testing.T) {
+	const max = 64
+	b := pathological(1 << 14)
+	for _, expr := range []string{`(a|b)*a.{20}$`, `a[ab]{12}b$`, `^b.{10}a`, `\ba[ab]{12}\b`, `x`} {
+		want := grep(mustCompile(t, "(?m)"+expr), b)
+
+		re := mustCompile(t, "(?m)"+expr)
+		re.SetMaxStates(max)
+		got := grep(re, b)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%#q with %d states: grep = %v, want %v", expr, max, got, want)
+		}
+		if st := re.Stats(); st.States > max {
+			t.Errorf("%#q: %d states cached, limit is %d", expr, st.States, max)
+		}
+	}
+}
+
+func TestMaxStatesFallback(t *testing.T) {
+	b := pathological(1 << 14)
+	re := mustCompile(t, `(?m)(a|b)*a.{20}$`)
+	re.SetMaxStates(16)
+	lines := grep(re, b)
+	st := re.Stats()
+	if st.Flushes == 0 || st.NFAFallbacks == 0 {
+		t.Errorf("Stats() = %+v, want flushes and NFA fallbacks", st)
+	}
+	if st.States > st.MaxStates {
+		t.Errorf("Stats() = %+v, more states than the limit", st)
+	}
+
+	re = mustCompile(t, `(?m)(a|b)*a.{20}$`)
+	re.SetMaxStates(1 << 20)
+	if want := grep(re, b); !reflect.DeepEqual(lines, want) {
+		t.Errorf("grep with NFA fallback = %v, want %v", lines, want)
+	}
+}
+
+func mustCompile(t *testing.T, expr string) *Regexp {
+	t.Helper()
+	re, err := Compile(expr)
+	if err != nil {
+		t.Fatalf("Compile(%#q): %v", expr, err)
+	}
+	return re
+}
+
+func TestFoldConstants(t *testing.T) {
+	last := rune(-1)
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		if unicode.SimpleFold(r) == r {
+			continue
+		}
+		if last == -1 && r != minFold {
+			t.Errorf("minFold = %#U, want %#U", minFold, r)
+		}
+		last = r
+	}
+	if last != maxFold {
+		t.Errorf("maxFold = %#U, want %#U", maxFold, last)
+	}
+}
+
+func TestPike(t *testing.T) {
+	// Without word boundaries, the pike agrees with the standard
+	// library.
+	exprs := []string{`a+`, `(a)|(b)`, `x*`, `(?i)straße`, `^(\w+) (\w+)$`, `(a*)(a*)`, `.`, `$`}
+	texts := []string{"", "aab", "abba", "STRASSE straße", "hello world", "日本語 x", "xyz"}
+	for _, expr := range exprs {
+		std := regexp.MustCompile(expr)
+		prog, err := syntax.Compile(mustParse(t, expr).Simplify())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newPike(prog)
+		for _, text := range texts {
+			want := std.FindAllSubmatchIndex([]byte(text), -1)
+			if got := p.findAll([]byte(text)); !reflect.DeepEqual(got, want) {
+				t.Errorf("findAll(%#q, %q) = %v, want %v", expr, text, got, want)
+			}
+		}
+	}
+}
+
+func mustParse(t *testing.T, expr string) *syntax.Regexp {
+	t.Helper()
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		t.Fatalf("Parse(%#q): %v", expr, err)
+	}
+	return re
+}
+
+func TestWordBoundary(t *testing.T) {
+	// The DFA and the pike agree on which lines match.
+	text := "naïve café\nÉcole\n日本語 テキスト\nstraße_1 x\nΣοφία\na-b\nend"
+	for _, expr := range []string{`\b\w`, `\w\b`, `\B.\b`, `\b..\b`, `\bé`, `\Bé`, `\b語`, `e\b`, `ß\B`, `\b$`, `^\B`} {
+		re := mustCompile(t, "(?m)"+expr)
+		var want []int
+		for i, line := range strings.Split(text, "\n") {
+			if re.uni.match([]byte(line), 0) != nil {
+				want = append(want, i+1)
+			}
+		}
+		if got := grep(re, []byte(text)); !reflect.DeepEqual(got, want) {
+			t.Errorf("grep(%#q) = %v, pike matches lines %v", expr, got, want)
+		}
+	}
+}